@@ -1,6 +1,7 @@
 package connectors
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"github.com/adjust/goenv"
@@ -8,15 +9,32 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/streadway/amqp"
 	"gopkg.in/mgo.v2"
-	"github.com/roeepolegfiverr/gofiverr/logger"
+	"strings"
+	"sync"
+	"time"
 	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
 )
 
 type clients struct {
-	redisClients   map[string]*redis.Client
-	mongoClients   map[string]*mgo.Session
-	mySqlClients   map[string]*sql.DB
-	rabbitConsumer *amqp.Channel
+	// redisClients are the shared connections of NamedRedis, redisPools back WithNamedRedis.
+	redisClients *registry
+	redisPools   *registry
+	// redisWatchers follow the sentinels of the redis connections behind them.
+	redisWatchers *registry
+	mongoClients  *registry
+	mySqlClients  *registry
+	// replicatedClients are built on top of mySqlClients, they own no connections.
+	replicatedClients *registry
+	rabbitLock        sync.Mutex
+	rabbitConn        *amqp.Connection
+	rabbitConsumer    *amqp.Channel
+	// retiredRabbit are connections replaced after a secret rotation, the channels
+	// open on them keep working until shutdown.
+	retiredRabbit []*amqp.Connection
+	// stop is closed on shutdown to end the background reporters.
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 var (
@@ -34,11 +52,16 @@ var (
 func InitConnectors(cfg *goenv.Goenv, initRabbit bool) {
 	config = cfg
 	Clients = &clients{
-		redisClients:   make(map[string]*redis.Client),
-		mongoClients:   make(map[string]*mgo.Session),
-		mySqlClients:   make(map[string]*sql.DB),
-		rabbitConsumer: nil,
+		redisClients:      newRegistry(),
+		redisPools:        newRegistry(),
+		redisWatchers:     newRegistry(),
+		mongoClients:      newRegistry(),
+		mySqlClients:      newRegistry(),
+		replicatedClients: newRegistry(),
+		rabbitConsumer:    nil,
+		stop:              make(chan struct{}),
 	}
+	initSecrets(Clients.stop, Clients.secretsRotated)
 
 	// Only init Rabbit for workers
 	if initRabbit {
@@ -48,33 +71,69 @@ func InitConnectors(cfg *goenv.Goenv, initRabbit bool) {
 
 // ProperShutdown handle proper cleanup
 func (clients *clients) ProperShutdown() {
+	if err := clients.Shutdown(); err != nil {
+		logger.ErrorLog(err)
+	}
+}
 
-	// Close all mysql connections
-	for _, sqlDb := range clients.mySqlClients {
-		sqlDb.Close()
+// Shutdown closes every client and the rabbit connection, and reports the ones that
+// failed to close.
+func (clients *clients) Shutdown() error {
+	clients.stopOnce.Do(func() { close(clients.stop) })
+	failures := []string{}
+	closed := func(name string, err error) {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
 	}
 
+	// Close all mysql connections
+	clients.mySqlClients.each(func(name string, client interface{}) {
+		closed("mysql."+name, client.(*sql.DB).Close())
+	})
+
 	//Close Redis
-	for _, redisDb := range clients.redisClients {
-		redisDb.Close()
-	}
+	clients.redisClients.each(func(name string, client interface{}) {
+		closed("redis."+name, client.(*redis.Client).Close())
+	})
+	clients.redisPools.each(func(name string, pool interface{}) {
+		pool.(*redisPool).close()
+	})
 
 	//Close Mongo
-	for _, mongoDb := range clients.mySqlClients {
-		mongoDb.Close()
-	}
+	clients.mongoClients.each(func(name string, client interface{}) {
+		client.(*mgo.Session).Close()
+	})
 
+	clients.rabbitLock.Lock()
+	defer clients.rabbitLock.Unlock()
 	if clients.rabbitConsumer != nil {
-		clients.rabbitConsumer.Close()
+		closed("rabbit channel", clients.rabbitConsumer.Close())
+		clients.rabbitConsumer = nil
+	}
+	if clients.rabbitConn != nil {
+		closed("rabbit", clients.rabbitConn.Close())
+		clients.rabbitConn = nil
 	}
+	for _, conn := range clients.retiredRabbit {
+		closed("rabbit", conn.Close())
+	}
+	clients.retiredRabbit = nil
+
+	if len(failures) > 0 {
+		return errors.Newf("Failed to close %s", strings.Join(failures, ", "))
+	}
+	return nil
 }
 
 func (clients *clients) Rabbit() (channel *amqp.Channel) {
+	Clients.rabbitLock.Lock()
+	defer Clients.rabbitLock.Unlock()
 
 	if Clients.rabbitConsumer != nil {
 		return Clients.rabbitConsumer
 	}
-	conn, err := amqp.Dial(config.GetNamedAmqp("rabbit"))
+	conn, err := dialRabbit()
 	if err != nil {
 		fmt.Printf("error connecting rabbit %s", err)
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
@@ -87,10 +146,27 @@ func (clients *clients) Rabbit() (channel *amqp.Channel) {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
 		panic(err)
 	}
+	Clients.rabbitConn = conn
 	Clients.rabbitConsumer = channel
 	return
 }
 
+// NewRabbitChannel opens a new channel on the shared rabbit connection.
+// The caller owns the channel and is responsible for closing it.
+func (clients *clients) NewRabbitChannel() (channel *amqp.Channel, err error) {
+	clients.Rabbit()
+	clients.rabbitLock.Lock()
+	conn := clients.rabbitConn
+	clients.rabbitLock.Unlock()
+
+	channel, err = conn.Channel()
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return nil, err
+	}
+	return channel, nil
+}
+
 // Get the default MySql client
 func (clients *clients) MySql() (client *sql.DB, err error) {
 	return clients.NamedMySql("default")
@@ -98,25 +174,36 @@ func (clients *clients) MySql() (client *sql.DB, err error) {
 
 // Get named MySql connection
 func (clients *clients) NamedMySql(clientName string) (client *sql.DB, err error) {
-	if client, ok := clients.mySqlClients[clientName]; ok {
-		return client, nil
+	created, err := clients.mySqlClients.get(clientName, func() (interface{}, error) {
+		return clients.createMySqlClient(clientName)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return clients.createMySqlClient(clientName)
+	return created.(*sql.DB), nil
 }
 
 // Get the default Redis client
+//
+// Deprecated: the client is a single connection shared by every caller, use WithRedis.
 func (clients *clients) Redis() (client *redis.Client, err error) {
 	return clients.NamedRedis("default")
 }
 
-// Get named Redis connection
+// Get named Redis connection. Sentinel is followed like with WithNamedRedis, but a
+// cluster can't be reached through a single connection: NamedRedis fails for a redis
+// in cluster mode, before dialing anything.
+//
+// Deprecated: the client is a single connection shared by every caller and isn't safe
+// for concurrent use, use WithNamedRedis.
 func (clients *clients) NamedRedis(clientName string) (client *redis.Client, err error) {
-	if client, ok := clients.redisClients[clientName]; ok {
-		return client, nil
+	created, err := clients.redisClients.get(clientName, func() (interface{}, error) {
+		return clients.createRedisClient(clientName)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return clients.createRedisClient(clientName)
+	return created.(*redis.Client), nil
 }
 
 // Get the default Mongo client
@@ -126,74 +213,89 @@ func (clients *clients) Mongo() (client *mgo.Session, err error) {
 
 // Get named Mongo connection
 func (clients *clients) NamedMongo(clientName string) (client *mgo.Session, err error) {
-	if client, ok := clients.mongoClients[clientName]; ok {
-		// always return a copy of a session.
-		return client.Copy(), nil
+	created, err := clients.mongoClients.get(clientName, func() (interface{}, error) {
+		return clients.createMongoClient(clientName)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	client, err = clients.createMongoClient(clientName)
-
 	// always return a copy of a session.
-	return client.Copy(), err
+	return created.(*mgo.Session).Copy(), nil
 }
 
 func (clients *clients) createMySqlClient(clientName string) (client *sql.DB, err error) {
-	user := config.Get(fmt.Sprintf("mysql.%s.user", clientName), "root")
-	password := config.Get(fmt.Sprintf("mysql.%s.password", clientName), "")
-	host := config.Get(fmt.Sprintf("mysql.%s.host", clientName), "localhost")
-	port := config.GetInt(fmt.Sprintf("mysql.%s.port", clientName), 3306)
-	dbName := config.Get(fmt.Sprintf("mysql.%s.database", clientName), "fiverr_dev")
-
-	fmt.Println(fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", user, password, host, port, dbName))
-	client, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", user, password, host, port, dbName))
+	cfg, err := mySqlConfig(clientName)
+	if err == nil {
+		err = registerMySqlTLS(clientName)
+	}
 	if err != nil {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
 		return nil, err
 	}
+	client = sql.OpenDB(mySqlConnector{clientName})
 
 	// Open doesn't open a connection. Validate DSN data:
 	err = client.Ping()
 	if err != nil {
-		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		client.Close()
+		logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("Couldn't connect mysql %s", redactedDSN(cfg))))
 		return nil, err
 	}
 
-	client.SetMaxOpenConns(10) //TODO: Ask Marina
-	clients.mySqlClients[clientName] = client
+	configureMySqlPool(clientName, client)
+	go reportMySqlStats(clientName, client, clients.stop)
 	return client, nil
 
 }
 
 func (clients *clients) createRedisClient(clientName string) (client *redis.Client, err error) {
-	host := config.Get(fmt.Sprintf("redis.%s.host", clientName), "localhost")
-	port := config.GetInt(fmt.Sprintf("redis.%s.port", clientName), 6379)
-
-	client, err = redis.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	cfg, err := redisPoolConfig(clientName)
+	if err == nil {
+		err = singleRedis(clientName)
+	}
 	if err != nil {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
 		return nil, err
 	}
-
-	clients.redisClients[clientName] = client
+	client, err = dialRedisTimeout(clientName, cfg)
+	if err != nil {
+		return nil, err
+	}
+	clients.watchRedisMaster(clientName)
 	return client, nil
 }
 
-func (clients *clients) createMongoClient(clientName string) (client *mgo.Session, err error) {
-	url := config.Get(fmt.Sprintf("mongo.%s", clientName), "localhost:27017/fiverr_dev")
-	// dbName := config.Get(fmt.Sprintf("mongo.%s.db", clientName), "fiverr_dev")
-
-	client, err = mgo.Dial(url)
+// NewRedisConnection dials a Redis connection for clientName that is not shared with
+// anyone. The caller owns it and should close it, this is what blocking commands need.
+// block is the longest a command blocks on it, it is added to the read timeout so a
+// blocking read isn't cut short. Like NamedRedis, it fails for a redis in cluster mode.
+func (clients *clients) NewRedisConnection(clientName string, block time.Duration) (client *redis.Client, err error) {
+	cfg, err := redisPoolConfig(clientName)
+	if err == nil {
+		err = singleRedis(clientName)
+	}
 	if err != nil {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
 		return nil, err
 	}
+	if cfg.ReadTimeout > 0 {
+		cfg.ReadTimeout += block
+	}
+	return dialRedisTimeout(clientName, cfg)
+}
 
-	clients.mongoClients[clientName] = client
+func (clients *clients) createMongoClient(clientName string) (client *mgo.Session, err error) {
+	client, err = dialMongo(clientName)
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return nil, err
+	}
 	return client, nil
 }
 
 func (clients *clients) createRabbit() (channel *amqp.Channel, err error) {
-	conn, err := amqp.Dial(config.GetNamedAmqp("rabbit"))
+	conn, err := dialRabbit()
 	if err != nil {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
 		return nil, err
@@ -205,6 +307,93 @@ func (clients *clients) createRabbit() (channel *amqp.Channel, err error) {
 		return nil, err
 	}
 
+	clients.rabbitLock.Lock()
+	defer clients.rabbitLock.Unlock()
+	clients.rabbitConn = conn
 	clients.rabbitConsumer = channel
 	return channel, nil
 }
+
+// secretsRotated reconnects the clients that keep their connections, and with them
+// the credentials they were dialed with: mongo and rabbit. MySql and Redis dial new
+// connections with the rotated secrets by themselves.
+func (clients *clients) secretsRotated(changed map[string]bool) {
+	clients.mongoClients.each(func(name string, client interface{}) {
+		if !changed[config.Get(fmt.Sprintf("mongo.%s.password", name), "")] {
+			return
+		}
+		// the next NamedMongo dials again, sessions copied from this one keep working
+		// until they are closed
+		if session, ok := clients.mongoClients.remove(name).(*mgo.Session); ok {
+			session.Close()
+		}
+	})
+	if changed[config.Get("rabbit.password", "")] {
+		clients.redialRabbit()
+	}
+}
+
+// redialRabbit replaces the shared rabbit connection with a new one, for the channels
+// opened from now on.
+func (clients *clients) redialRabbit() {
+	clients.rabbitLock.Lock()
+	connected := clients.rabbitConn != nil
+	clients.rabbitLock.Unlock()
+	if !connected {
+		return
+	}
+	conn, err := dialRabbit()
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, "Couldn't reconnect rabbit with the rotated password"))
+		return
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return
+	}
+	clients.rabbitLock.Lock()
+	defer clients.rabbitLock.Unlock()
+	clients.retiredRabbit = append(clients.retiredRabbit, clients.rabbitConn)
+	clients.rabbitConn = conn
+	clients.rabbitConsumer = channel
+}
+
+// dialRabbit connects to the rabbit amqp url. rabbit.username and rabbit.password
+// override the credentials in the url, and amqps urls use the TLS config under
+// rabbit.tls.*, e.g. for client certificates. With rabbit.tls.enabled the url must be
+// an amqps one, the connection would be in plain text otherwise.
+func dialRabbit() (*amqp.Connection, error) {
+	uri, err := amqp.ParseURI(config.GetNamedAmqp("rabbit"))
+	if err != nil {
+		return nil, err
+	}
+	if username := config.Get("rabbit.username", ""); username != "" {
+		uri.Username = username
+		if uri.Password, err = configSecret("rabbit.password"); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsCfg, err := tlsConfig("rabbit")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRabbitTLS(uri, tlsCfg); err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		return amqp.DialTLS(uri.String(), tlsCfg)
+	}
+	return amqp.Dial(uri.String())
+}
+
+// checkRabbitTLS refuses TLS settings for a plain amqp url, amqp.DialTLS ignores them
+// for one.
+func checkRabbitTLS(uri amqp.URI, tlsCfg *tls.Config) error {
+	if tlsCfg != nil && uri.Scheme != "amqps" {
+		return errors.Newf("rabbit.tls is enabled but the rabbit url is %s://, use amqps://", uri.Scheme)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package connectors
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckTimeout limits every dependency check when the context has no deadline.
+var HealthCheckTimeout = 2 * time.Second
+
+var (
+	healthLock sync.Mutex
+	// healthRunning are the checks that haven't returned yet. A check that timed out
+	// isn't started again until it returns, so a hung dependency doesn't pile up
+	// goroutines on every probe.
+	healthRunning = map[string]bool{}
+)
+
+// DependencyHealth is the result of checking a single client, e.g. mysql.default.
+type DependencyHealth struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Health is the result of checking every initialized client.
+type Health struct {
+	Healthy      bool               `json:"healthy"`
+	Dependencies []DependencyHealth `json:"dependencies"`
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// HealthCheck pings every MySql, Redis, Mongo and RabbitMQ client that was created so
+// far, concurrently. It is healthy when all of them answered in time.
+func (clients *clients) HealthCheck(ctx context.Context) Health {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, HealthCheckTimeout)
+		defer cancel()
+	}
+
+	checks := clients.healthChecks(ctx)
+	health := Health{Healthy: true, Dependencies: make([]DependencyHealth, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			health.Dependencies[i] = runHealthCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, dependency := range health.Dependencies {
+		if !dependency.Healthy {
+			health.Healthy = false
+		}
+	}
+	return health
+}
+
+func (clients *clients) healthChecks(ctx context.Context) []healthCheck {
+	checks := []healthCheck{}
+	clients.mySqlClients.each(func(name string, client interface{}) {
+		db := client.(*sql.DB)
+		checks = append(checks, healthCheck{"mysql." + name, func() error {
+			return db.PingContext(ctx)
+		}})
+	})
+
+	// a connection of its own, a busy pool doesn't mean redis is down
+	clients.redisPools.each(func(name string, pool interface{}) {
+		checks = append(checks, healthCheck{"redis." + name, func() error {
+			return pingRedis(ctx, name)
+		}})
+	})
+
+	clients.mongoClients.each(func(name string, client interface{}) {
+		session := client.(*mgo.Session)
+		checks = append(checks, healthCheck{"mongo." + name, func() error {
+			copied := session.Copy()
+			defer copied.Close()
+			return copied.Ping()
+		}})
+	})
+
+	clients.rabbitLock.Lock()
+	conn := clients.rabbitConn
+	clients.rabbitLock.Unlock()
+	if conn != nil {
+		checks = append(checks, healthCheck{"rabbit", func() error {
+			channel, err := conn.Channel()
+			if err != nil {
+				return err
+			}
+			return channel.Close()
+		}})
+	}
+	return checks
+}
+
+// pingRedis dials clientName, pings it and hangs up, every step limited by the time
+// left until ctx is done.
+func pingRedis(ctx context.Context, clientName string) error {
+	cfg, err := redisPoolConfig(clientName)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		cfg.DialTimeout, cfg.ReadTimeout, cfg.WriteTimeout = left, left, left
+	}
+	conn, err := dialPooledRedis(clientName, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if redisTopologyConfig(clientName).mode == redisCluster {
+		// the cluster client routes commands by their first argument, PING echoes it
+		return conn.Cmd("PING", "health").Err
+	}
+	return conn.Cmd("PING").Err
+}
+
+// runHealthCheck gives up on checks that don't answer before ctx is done, most
+// drivers can't be interrupted so the check itself is left to finish in the background.
+// Until it does the dependency is reported down without checking it again.
+func runHealthCheck(ctx context.Context, check healthCheck) DependencyHealth {
+	start := time.Now()
+	healthLock.Lock()
+	running := healthRunning[check.name]
+	healthRunning[check.name] = true
+	healthLock.Unlock()
+	if running {
+		return DependencyHealth{Name: check.name, Error: "The previous check didn't return yet"}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			healthLock.Lock()
+			delete(healthRunning, check.name)
+			healthLock.Unlock()
+		}()
+		result <- check.check()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	health := DependencyHealth{
+		Name:      check.name,
+		Healthy:   err == nil,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// RegisterHealthRoutes adds the probes Kubernetes expects:
+//
+//	GET /health/live   - the process is up
+//	GET /health/ready  - every dependency is reachable, 503 otherwise
+func RegisterHealthRoutes(router gin.IRoutes) {
+	router.GET("/health/live", LiveHandler)
+	router.GET("/health/ready", ReadyHandler)
+}
+
+// LiveHandler always answers ok, it doesn't check the dependencies so a database
+// outage won't get the pods restarted.
+func LiveHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyHandler answers with the HealthCheck result.
+func ReadyHandler(c *gin.Context) {
+	health := Clients.HealthCheck(c.Request.Context())
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, health)
+}
@@ -0,0 +1,64 @@
+package connectors
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunHealthCheck(t *testing.T) {
+	ok := runHealthCheck(context.Background(), healthCheck{"mysql.default", func() error { return nil }})
+	if !ok.Healthy || ok.Name != "mysql.default" || ok.Error != "" {
+		t.Errorf("Unexpected result %+v", ok)
+	}
+
+	failed := runHealthCheck(context.Background(), healthCheck{"redis.default", func() error {
+		return errors.New("connection refused")
+	}})
+	if failed.Healthy || failed.Error != "connection refused" {
+		t.Errorf("Unexpected result %+v", failed)
+	}
+}
+
+func TestRunHealthCheckTimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result := runHealthCheck(ctx, healthCheck{"mongo.default", func() error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+	if result.Healthy || result.LatencyMs >= 1000 {
+		t.Errorf("Expected the check to time out, got %+v", result)
+	}
+}
+
+func TestHealthCheckWithoutClients(t *testing.T) {
+	c := &clients{redisPools: newRegistry(), mongoClients: newRegistry(), mySqlClients: newRegistry()}
+	if health := c.HealthCheck(context.Background()); !health.Healthy || len(health.Dependencies) != 0 {
+		t.Errorf("Expected nothing to check, got %+v", health)
+	}
+}
+
+func TestRunHealthCheckWaitsForTimedOutCheck(t *testing.T) {
+	release := make(chan bool)
+	var started int32
+	check := healthCheck{"rabbit", func() error {
+		atomic.AddInt32(&started, 1)
+		<-release
+		return nil
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	runHealthCheck(ctx, check)
+
+	if result := runHealthCheck(context.Background(), check); result.Healthy || atomic.LoadInt32(&started) != 1 {
+		t.Errorf("Expected the hung check not to be started again, got %+v", result)
+	}
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	if result := runHealthCheck(context.Background(), check); !result.Healthy || atomic.LoadInt32(&started) != 2 {
+		t.Errorf("Expected the check to run again once it returned, got %+v", result)
+	}
+}
@@ -0,0 +1,356 @@
+package connectors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"gopkg.in/mgo.v2"
+	"strings"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/statsd"
+)
+
+// instrument times the operations of one connection as <kind>.<name>.<operation>
+// statsd timers, counts their failures as <kind>.<name>.<operation>.errors and logs
+// the ones slower than <kind>.<name>.slow_threshold.
+type instrument struct {
+	prefix string
+	slow   time.Duration
+}
+
+func newInstrument(kind string, clientName string) instrument {
+	return instrument{
+		prefix: fmt.Sprintf("%s.%s", kind, clientName),
+		slow:   configDuration(fmt.Sprintf("%s.%s.slow_threshold", kind, clientName), "500ms"),
+	}
+}
+
+// statsdTiming and statsdIncrement report the metrics, tests replace them.
+var (
+	statsdTiming    = statsd.Timing
+	statsdIncrement = statsd.Increment
+)
+
+func (in instrument) observe(operation string, start time.Time, err error, detail string) {
+	elapsed := time.Since(start)
+	metric := in.prefix + "." + operation
+	statsdTiming(metric, elapsed)
+	if err != nil {
+		statsdIncrement(metric + ".errors")
+	}
+	if in.slow > 0 && elapsed > in.slow {
+		logger.WarningLog(errors.Newf("Slow %s took %s: %s", metric, elapsed, detail))
+	}
+}
+
+// InstrumentedDB is a *sql.DB whose queries, execs and transactions are timed.
+type InstrumentedDB struct {
+	*sql.DB
+	instrument instrument
+}
+
+// InstrumentedMySql returns the default MySql client, instrumented.
+func (clients *clients) InstrumentedMySql() (*InstrumentedDB, error) {
+	return clients.NamedInstrumentedMySql("default")
+}
+
+// NamedInstrumentedMySql returns the clientName MySql client, instrumented as mysql.<name>.
+func (clients *clients) NamedInstrumentedMySql(clientName string) (*InstrumentedDB, error) {
+	db, err := clients.NamedMySql(clientName)
+	if err != nil {
+		return nil, err
+	}
+	return &InstrumentedDB{DB: db, instrument: newInstrument("mysql", clientName)}, nil
+}
+
+func (db *InstrumentedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *InstrumentedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	defer func(start time.Time) { db.instrument.observe("query", start, err, query) }(time.Now())
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *InstrumentedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *InstrumentedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	defer func(start time.Time) { db.instrument.observe("query_row", start, row.Err(), query) }(time.Now())
+	return db.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (db *InstrumentedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *InstrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	defer func(start time.Time) { db.instrument.observe("exec", start, err, query) }(time.Now())
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+func (db *InstrumentedDB) Begin() (*InstrumentedTx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+func (db *InstrumentedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*InstrumentedTx, error) {
+	var err error
+	defer func(start time.Time) { db.instrument.observe("begin", start, err, "begin") }(time.Now())
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &InstrumentedTx{Tx: tx, instrument: db.instrument}, nil
+}
+
+// InstrumentedTx is a *sql.Tx whose statements are timed like the ones of the
+// InstrumentedDB it was started on, and its commit and rollback too.
+type InstrumentedTx struct {
+	*sql.Tx
+	instrument instrument
+}
+
+func (tx *InstrumentedTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *InstrumentedTx) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	defer func(start time.Time) { tx.instrument.observe("query", start, err, query) }(time.Now())
+	return tx.Tx.QueryContext(ctx, query, args...)
+}
+
+func (tx *InstrumentedTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *InstrumentedTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	defer func(start time.Time) { tx.instrument.observe("query_row", start, row.Err(), query) }(time.Now())
+	return tx.Tx.QueryRowContext(ctx, query, args...)
+}
+
+func (tx *InstrumentedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *InstrumentedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	defer func(start time.Time) { tx.instrument.observe("exec", start, err, query) }(time.Now())
+	return tx.Tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *InstrumentedTx) Commit() (err error) {
+	defer func(start time.Time) { tx.instrument.observe("commit", start, err, "commit") }(time.Now())
+	return tx.Tx.Commit()
+}
+
+func (tx *InstrumentedTx) Rollback() (err error) {
+	defer func(start time.Time) { tx.instrument.observe("rollback", start, err, "rollback") }(time.Now())
+	return tx.Tx.Rollback()
+}
+
+// instrumentedRedis times every command as redis.<name>.<COMMAND>. Only the command
+// name is logged for slow commands, the arguments may hold anything.
+type instrumentedRedis struct {
+	conn       RedisConn
+	instrument instrument
+}
+
+func (r *instrumentedRedis) Cmd(cmd string, args ...interface{}) (reply *redis.Reply) {
+	operation := strings.ToUpper(cmd)
+	defer func(start time.Time) { r.instrument.observe(operation, start, reply.Err, operation) }(time.Now())
+	return r.conn.Cmd(cmd, args...)
+}
+
+// WithMongo runs fn on a copy of the default Mongo session, see WithNamedMongo.
+func (clients *clients) WithMongo(operation string, fn func(db *InstrumentedMongo) error) error {
+	return clients.WithNamedMongo("default", operation, fn)
+}
+
+// WithNamedMongo runs fn on a copy of the clientName Mongo session and times it as
+// mongo.<name>.<operation>, e.g. mongo.default.find_users. The operations fn runs
+// through the database it gets are timed too, see InstrumentedCollection.
+func (clients *clients) WithNamedMongo(clientName string, operation string, fn func(db *InstrumentedMongo) error) (err error) {
+	session, err := clients.NamedMongo(clientName)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	in := newInstrument("mongo", clientName)
+	defer func(start time.Time) { in.observe(operation, start, err, operation) }(time.Now())
+	return fn(&InstrumentedMongo{Database: session.DB(""), instrument: in})
+}
+
+// InstrumentedMongo is a *mgo.Database whose collections are instrumented.
+type InstrumentedMongo struct {
+	*mgo.Database
+	instrument instrument
+}
+
+func (db *InstrumentedMongo) C(name string) *InstrumentedCollection {
+	return &InstrumentedCollection{
+		Collection: db.Database.C(name),
+		instrument: instrument{prefix: db.instrument.prefix + "." + name, slow: db.instrument.slow},
+	}
+}
+
+// InstrumentedCollection is a *mgo.Collection whose writes and queries are timed as
+// mongo.<name>.<collection>.<operation>, e.g. mongo.default.users.find_all. Queries
+// are timed when they run, by All, One, Count, Distinct or Apply, iterators aren't
+// timed. Only the operation is logged for slow ones, the documents may hold anything.
+type InstrumentedCollection struct {
+	*mgo.Collection
+	instrument instrument
+}
+
+func (c *InstrumentedCollection) observe(operation string, start time.Time, err error) {
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	c.instrument.observe(operation, start, err, c.FullName+" "+operation)
+}
+
+func (c *InstrumentedCollection) Find(query interface{}) *InstrumentedQuery {
+	return &InstrumentedQuery{Query: c.Collection.Find(query), collection: c}
+}
+
+func (c *InstrumentedCollection) FindId(id interface{}) *InstrumentedQuery {
+	return &InstrumentedQuery{Query: c.Collection.FindId(id), collection: c}
+}
+
+func (c *InstrumentedCollection) Pipe(pipeline interface{}) *InstrumentedPipe {
+	return &InstrumentedPipe{Pipe: c.Collection.Pipe(pipeline), collection: c}
+}
+
+func (c *InstrumentedCollection) Count() (n int, err error) {
+	defer func(start time.Time) { c.observe("count", start, err) }(time.Now())
+	return c.Collection.Count()
+}
+
+func (c *InstrumentedCollection) Insert(docs ...interface{}) (err error) {
+	defer func(start time.Time) { c.observe("insert", start, err) }(time.Now())
+	return c.Collection.Insert(docs...)
+}
+
+func (c *InstrumentedCollection) Update(selector interface{}, update interface{}) (err error) {
+	defer func(start time.Time) { c.observe("update", start, err) }(time.Now())
+	return c.Collection.Update(selector, update)
+}
+
+func (c *InstrumentedCollection) UpdateId(id interface{}, update interface{}) (err error) {
+	defer func(start time.Time) { c.observe("update", start, err) }(time.Now())
+	return c.Collection.UpdateId(id, update)
+}
+
+func (c *InstrumentedCollection) UpdateAll(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	defer func(start time.Time) { c.observe("update_all", start, err) }(time.Now())
+	return c.Collection.UpdateAll(selector, update)
+}
+
+func (c *InstrumentedCollection) Upsert(selector interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	defer func(start time.Time) { c.observe("upsert", start, err) }(time.Now())
+	return c.Collection.Upsert(selector, update)
+}
+
+func (c *InstrumentedCollection) UpsertId(id interface{}, update interface{}) (info *mgo.ChangeInfo, err error) {
+	defer func(start time.Time) { c.observe("upsert", start, err) }(time.Now())
+	return c.Collection.UpsertId(id, update)
+}
+
+func (c *InstrumentedCollection) Remove(selector interface{}) (err error) {
+	defer func(start time.Time) { c.observe("remove", start, err) }(time.Now())
+	return c.Collection.Remove(selector)
+}
+
+func (c *InstrumentedCollection) RemoveId(id interface{}) (err error) {
+	defer func(start time.Time) { c.observe("remove", start, err) }(time.Now())
+	return c.Collection.RemoveId(id)
+}
+
+func (c *InstrumentedCollection) RemoveAll(selector interface{}) (info *mgo.ChangeInfo, err error) {
+	defer func(start time.Time) { c.observe("remove_all", start, err) }(time.Now())
+	return c.Collection.RemoveAll(selector)
+}
+
+// InstrumentedQuery is a *mgo.Query that is timed when it runs. Not found isn't
+// counted as an error.
+type InstrumentedQuery struct {
+	*mgo.Query
+	collection *InstrumentedCollection
+}
+
+func (q *InstrumentedQuery) chain(query *mgo.Query) *InstrumentedQuery {
+	return &InstrumentedQuery{Query: query, collection: q.collection}
+}
+
+func (q *InstrumentedQuery) Sort(fields ...string) *InstrumentedQuery {
+	return q.chain(q.Query.Sort(fields...))
+}
+
+func (q *InstrumentedQuery) Select(selector interface{}) *InstrumentedQuery {
+	return q.chain(q.Query.Select(selector))
+}
+
+func (q *InstrumentedQuery) Limit(n int) *InstrumentedQuery {
+	return q.chain(q.Query.Limit(n))
+}
+
+func (q *InstrumentedQuery) Skip(n int) *InstrumentedQuery {
+	return q.chain(q.Query.Skip(n))
+}
+
+func (q *InstrumentedQuery) Batch(n int) *InstrumentedQuery {
+	return q.chain(q.Query.Batch(n))
+}
+
+func (q *InstrumentedQuery) Hint(indexKey ...string) *InstrumentedQuery {
+	return q.chain(q.Query.Hint(indexKey...))
+}
+
+func (q *InstrumentedQuery) SetMaxTime(d time.Duration) *InstrumentedQuery {
+	return q.chain(q.Query.SetMaxTime(d))
+}
+
+func (q *InstrumentedQuery) All(result interface{}) (err error) {
+	defer func(start time.Time) { q.collection.observe("find_all", start, err) }(time.Now())
+	return q.Query.All(result)
+}
+
+func (q *InstrumentedQuery) One(result interface{}) (err error) {
+	defer func(start time.Time) { q.collection.observe("find_one", start, err) }(time.Now())
+	return q.Query.One(result)
+}
+
+func (q *InstrumentedQuery) Count() (n int, err error) {
+	defer func(start time.Time) { q.collection.observe("count", start, err) }(time.Now())
+	return q.Query.Count()
+}
+
+func (q *InstrumentedQuery) Distinct(key string, result interface{}) (err error) {
+	defer func(start time.Time) { q.collection.observe("distinct", start, err) }(time.Now())
+	return q.Query.Distinct(key, result)
+}
+
+func (q *InstrumentedQuery) Apply(change mgo.Change, result interface{}) (info *mgo.ChangeInfo, err error) {
+	defer func(start time.Time) { q.collection.observe("find_and_modify", start, err) }(time.Now())
+	return q.Query.Apply(change, result)
+}
+
+// InstrumentedPipe is a *mgo.Pipe timed as <collection>.aggregate when it runs.
+type InstrumentedPipe struct {
+	*mgo.Pipe
+	collection *InstrumentedCollection
+}
+
+func (p *InstrumentedPipe) All(result interface{}) (err error) {
+	defer func(start time.Time) { p.collection.observe("aggregate", start, err) }(time.Now())
+	return p.Pipe.All(result)
+}
+
+func (p *InstrumentedPipe) One(result interface{}) (err error) {
+	defer func(start time.Time) { p.collection.observe("aggregate", start, err) }(time.Now())
+	return p.Pipe.One(result)
+}
@@ -0,0 +1,125 @@
+package connectors
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/fzzy/radix/redis"
+	"gopkg.in/mgo.v2"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingRedis struct {
+	commands []string
+}
+
+func (conn *recordingRedis) Cmd(cmd string, args ...interface{}) *redis.Reply {
+	conn.commands = append(conn.commands, cmd)
+	if cmd == "bad" {
+		return &redis.Reply{Type: redis.ErrorReply, Err: errors.New("ERR unknown command")}
+	}
+	return &redis.Reply{}
+}
+
+// fakeStatsd records the metrics reported while a test runs.
+type fakeStatsd struct {
+	lock    sync.Mutex
+	metrics []string
+}
+
+func recordStatsd(t *testing.T) *fakeStatsd {
+	fake := &fakeStatsd{}
+	timing, increment := statsdTiming, statsdIncrement
+	statsdTiming = func(name string, elapsed time.Duration) { fake.record("timing " + name) }
+	statsdIncrement = func(name string) { fake.record("increment " + name) }
+	t.Cleanup(func() { statsdTiming, statsdIncrement = timing, increment })
+	return fake
+}
+
+func (fake *fakeStatsd) record(metric string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.metrics = append(fake.metrics, metric)
+}
+
+func (fake *fakeStatsd) expect(t *testing.T, expected ...string) {
+	t.Helper()
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if !reflect.DeepEqual(fake.metrics, expected) {
+		t.Errorf("Expected metrics %v got %v", expected, fake.metrics)
+	}
+}
+
+func TestInstrumentedRedisPassesCommandsThrough(t *testing.T) {
+	fake := recordStatsd(t)
+	conn := &recordingRedis{}
+	instrumented := &instrumentedRedis{conn: conn, instrument: instrument{prefix: "redis.cache", slow: time.Hour}}
+	if reply := instrumented.Cmd("get", "key"); reply == nil || reply.Err != nil {
+		t.Errorf("Unexpected reply %v", reply)
+	}
+	instrumented.Cmd("bad")
+	if len(conn.commands) != 2 || conn.commands[0] != "get" {
+		t.Errorf("Expected the commands to reach the connection, got %v", conn.commands)
+	}
+	fake.expect(t, "timing redis.cache.GET", "timing redis.cache.BAD", "increment redis.cache.BAD.errors")
+}
+
+func TestInstrumentedTxTimesStatements(t *testing.T) {
+	fake := recordStatsd(t)
+	db := &InstrumentedDB{DB: sql.OpenDB(fakeTxConnector{}), instrument: instrument{prefix: "mysql.default"}}
+	defer db.Close()
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE orders SET paid = 1"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Exec("fail")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	fake.expect(t,
+		"timing mysql.default.begin",
+		"timing mysql.default.exec",
+		"timing mysql.default.exec", "increment mysql.default.exec.errors",
+		"timing mysql.default.commit",
+	)
+}
+
+func TestInstrumentedCollectionMetricNames(t *testing.T) {
+	fake := recordStatsd(t)
+	db := &InstrumentedMongo{Database: &mgo.Database{Name: "app"}, instrument: instrument{prefix: "mongo.default"}}
+	users := db.C("users")
+	start := time.Now()
+	users.observe("find_one", start, mgo.ErrNotFound)
+	users.observe("insert", start, errors.New("duplicate key"))
+	fake.expect(t, "timing mongo.default.users.find_one", "timing mongo.default.users.insert", "increment mongo.default.users.insert.errors")
+}
+
+// fakeTxConnector is a database that accepts any statement but "fail".
+type fakeTxConnector struct{}
+
+func (fakeTxConnector) Connect(context.Context) (driver.Conn, error) { return fakeTxConn{}, nil }
+func (fakeTxConnector) Driver() driver.Driver                        { return nil }
+
+type fakeTxConn struct{}
+
+func (fakeTxConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeTxConn) Close() error                              { return nil }
+func (fakeTxConn) Begin() (driver.Tx, error)                 { return fakeTxConn{}, nil }
+func (fakeTxConn) Commit() error                             { return nil }
+func (fakeTxConn) Rollback() error                           { return nil }
+
+func (fakeTxConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if query == "fail" {
+		return nil, errors.New("syntax error")
+	}
+	return driver.RowsAffected(1), nil
+}
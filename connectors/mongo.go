@@ -0,0 +1,112 @@
+package connectors
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"net"
+	"strconv"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+var readPreferences = map[string]mgo.Mode{
+	"primary":             mgo.Primary,
+	"primary_preferred":   mgo.PrimaryPreferred,
+	"secondary":           mgo.Secondary,
+	"secondary_preferred": mgo.SecondaryPreferred,
+	"nearest":             mgo.Nearest,
+	"eventual":            mgo.Eventual,
+	"monotonic":           mgo.Monotonic,
+	"strong":              mgo.Strong,
+}
+
+// mongoURL reads mongo.<name>.url, falling back to the older mongo.<name>.
+func mongoURL(clientName string) string {
+	if url := config.Get(fmt.Sprintf("mongo.%s.url", clientName), ""); url != "" {
+		return url
+	}
+	return config.Get(fmt.Sprintf("mongo.%s", clientName), "localhost:27017/fiverr_dev")
+}
+
+// dialMongo connects clientName with the options under mongo.<name>.*:
+// replica_set, dial_timeout, socket_timeout, pool_limit, read_preference
+// (primary, secondary_preferred, nearest, ...) and the write concern as
+// write_concern (a number of servers or majority), journal and write_timeout.
+// username, password and auth_source override the credentials in the url, and
+// tls.* makes it connect over TLS.
+func dialMongo(clientName string) (*mgo.Session, error) {
+	key := func(option string) string {
+		return fmt.Sprintf("mongo.%s.%s", clientName, option)
+	}
+	info, err := mgo.ParseURL(mongoURL(clientName))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Invalid mongo url for %s", clientName))
+	}
+	if replicaSet := config.Get(key("replica_set"), ""); replicaSet != "" {
+		info.ReplicaSetName = replicaSet
+	}
+	info.Timeout = configDuration(key("dial_timeout"), "10s")
+	info.PoolLimit = config.GetInt(key("pool_limit"), 4096)
+	if username := config.Get(key("username"), ""); username != "" {
+		info.Username = username
+		if info.Password, err = configSecret(key("password")); err != nil {
+			return nil, err
+		}
+	}
+	if source := config.Get(key("auth_source"), ""); source != "" {
+		info.Source = source
+	}
+
+	tlsCfg, err := tlsConfig(fmt.Sprintf("mongo.%s", clientName))
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		dialer := &net.Dialer{Timeout: info.Timeout}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), tlsCfg)
+		}
+	}
+
+	mode, err := readPreference(config.Get(key("read_preference"), "strong"))
+	if err != nil {
+		return nil, err
+	}
+	safe := writeConcern(
+		config.Get(key("write_concern"), "1"),
+		config.Get(key("journal"), "false") == "true",
+		int(configDuration(key("write_timeout"), "0s").Milliseconds()),
+	)
+
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mode, true)
+	session.SetSafe(safe)
+	session.SetSocketTimeout(configDuration(key("socket_timeout"), "1m"))
+	return session, nil
+}
+
+func readPreference(name string) (mgo.Mode, error) {
+	mode, ok := readPreferences[name]
+	if !ok {
+		return mgo.Strong, errors.Newf("Unknown mongo read preference %s", name)
+	}
+	return mode, nil
+}
+
+// writeConcern builds the session safety mode, a write concern of 0 doesn't wait for
+// writes to be acknowledged at all.
+func writeConcern(w string, journal bool, timeoutMs int) *mgo.Safe {
+	safe := &mgo.Safe{J: journal, WTimeout: timeoutMs}
+	if servers, err := strconv.Atoi(w); err == nil {
+		if servers == 0 && !journal {
+			return nil
+		}
+		safe.W = servers
+	} else if w != "" {
+		safe.WMode = w
+	}
+	return safe
+}
@@ -0,0 +1,29 @@
+package connectors
+
+import (
+	"gopkg.in/mgo.v2"
+	"testing"
+)
+
+func TestReadPreference(t *testing.T) {
+	if mode, err := readPreference("secondary_preferred"); err != nil || mode != mgo.SecondaryPreferred {
+		t.Errorf("Unexpected mode %v %v", mode, err)
+	}
+	if _, err := readPreference("anywhere"); err == nil {
+		t.Errorf("Expected an unknown read preference to fail")
+	}
+}
+
+func TestWriteConcern(t *testing.T) {
+	safe := writeConcern("majority", true, 5000)
+	if safe.WMode != "majority" || !safe.J || safe.WTimeout != 5000 {
+		t.Errorf("Unexpected safe mode %+v", safe)
+	}
+	safe = writeConcern("2", false, 0)
+	if safe.W != 2 || safe.WMode != "" {
+		t.Errorf("Unexpected safe mode %+v", safe)
+	}
+	if safe = writeConcern("0", false, 0); safe != nil {
+		t.Errorf("Expected unacknowledged writes, got %+v", safe)
+	}
+}
@@ -0,0 +1,129 @@
+package connectors
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/statsd"
+)
+
+// mySqlConfig builds the driver config of clientName from mysql.<name>.* in the
+// config. The password may be a secret reference, see configSecret. Reads and writes
+// have no timeout unless read_timeout and write_timeout are set, long queries and
+// reports would otherwise be cut off.
+func mySqlConfig(clientName string) (*mysql.Config, error) {
+	key := func(option string) string {
+		return fmt.Sprintf("mysql.%s.%s", clientName, option)
+	}
+	password, err := configSecret(key("password"))
+	if err != nil {
+		return nil, err
+	}
+	cfg := mysql.NewConfig()
+	cfg.User = config.Get(key("user"), "root")
+	cfg.Passwd = password
+	cfg.Net = "tcp"
+	cfg.Addr = fmt.Sprintf("%s:%d", config.Get(key("host"), "localhost"), config.GetInt(key("port"), 3306))
+	cfg.DBName = config.Get(key("database"), "fiverr_dev")
+	cfg.ParseTime = config.Get(key("parse_time"), "false") == "true"
+	cfg.Timeout = configDuration(key("timeout"), "5s")
+	cfg.ReadTimeout = configDuration(key("read_timeout"), "0s")
+	cfg.WriteTimeout = configDuration(key("write_timeout"), "0s")
+	if charset := config.Get(key("charset"), ""); charset != "" {
+		cfg.Params = map[string]string{"charset": charset}
+	}
+	if tlsOptionsConfig(fmt.Sprintf("mysql.%s", clientName)).enabled {
+		cfg.TLSConfig = mySqlTLSName(clientName)
+	}
+	return cfg, nil
+}
+
+// mySqlTLSName is the name the TLS config of clientName is registered with the driver.
+func mySqlTLSName(clientName string) string {
+	return "gofiverr_" + clientName
+}
+
+// registerMySqlTLS registers the TLS config under mysql.<name>.tls.* with the driver,
+// which looks TLS configs up by name.
+func registerMySqlTLS(clientName string) error {
+	tlsCfg, err := tlsConfig(fmt.Sprintf("mysql.%s", clientName))
+	if err != nil || tlsCfg == nil {
+		return err
+	}
+	return mysql.RegisterTLSConfig(mySqlTLSName(clientName), tlsCfg)
+}
+
+// mySqlConnector builds the driver config again for every new connection, so a
+// rotated password is used as soon as the secrets are refreshed.
+type mySqlConnector struct {
+	clientName string
+}
+
+func (connector mySqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cfg, err := mySqlConfig(connector.clientName)
+	if err != nil {
+		return nil, err
+	}
+	mysqlConnector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return mysqlConnector.Connect(ctx)
+}
+
+func (connector mySqlConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+// redactedDSN is the DSN of cfg with the password hidden, safe to log.
+func redactedDSN(cfg *mysql.Config) string {
+	redacted := cfg.Clone()
+	if redacted.Passwd != "" {
+		redacted.Passwd = "****"
+	}
+	return redacted.FormatDSN()
+}
+
+// configureMySqlPool sizes the connection pool of clientName from mysql.<name>.*.
+func configureMySqlPool(clientName string, client *sql.DB) {
+	key := func(option string) string {
+		return fmt.Sprintf("mysql.%s.%s", clientName, option)
+	}
+	client.SetMaxOpenConns(config.GetInt(key("max_open_conns"), 10))
+	client.SetMaxIdleConns(config.GetInt(key("max_idle_conns"), 5))
+	client.SetConnMaxLifetime(configDuration(key("conn_max_lifetime"), "30m"))
+	client.SetConnMaxIdleTime(configDuration(key("conn_max_idle_time"), "5m"))
+}
+
+// reportMySqlStats sends the pool stats of clientName to statsd every
+// mysql.<name>.stats_interval until stop is closed. Zero disables it.
+func reportMySqlStats(clientName string, client *sql.DB, stop <-chan struct{}) {
+	interval := configDuration(fmt.Sprintf("mysql.%s.stats_interval", clientName), "10s")
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sendMySqlStats(clientName, client.Stats())
+		}
+	}
+}
+
+func sendMySqlStats(clientName string, stats sql.DBStats) {
+	prefix := fmt.Sprintf("mysql.%s.", clientName)
+	statsd.Gauge(prefix+"open_connections", stats.OpenConnections)
+	statsd.Gauge(prefix+"in_use", stats.InUse)
+	statsd.Gauge(prefix+"idle", stats.Idle)
+	statsd.Gauge(prefix+"wait_count", int(stats.WaitCount))
+	statsd.Gauge(prefix+"wait_duration_ms", int(stats.WaitDuration/time.Millisecond))
+	statsd.Gauge(prefix+"max_idle_closed", int(stats.MaxIdleClosed))
+	statsd.Gauge(prefix+"max_lifetime_closed", int(stats.MaxLifetimeClosed))
+}
@@ -0,0 +1,353 @@
+package connectors
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"net"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// RedisConn is a Redis connection borrowed from the pool, only the function it was
+// handed to may use it.
+type RedisConn interface {
+	Cmd(cmd string, args ...interface{}) *redis.Reply
+}
+
+type redisClient interface {
+	RedisConn
+	Close() error
+}
+
+// RedisPoolConfig is read from redis.<name>.* in the config.
+type RedisPoolConfig struct {
+	// Size is the most connections open at once, WithRedis waits when they are all in use.
+	Size int
+	// PoolTimeout is the longest WithRedis waits for a free connection. Zero waits as
+	// long as it takes.
+	PoolTimeout time.Duration
+	// IdleTimeout closes connections that weren't used for that long. Zero keeps them.
+	IdleTimeout time.Duration
+	// DialTimeout, ReadTimeout and WriteTimeout limit each network operation. Zero
+	// means no limit.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Username and Password are sent with AUTH, Username only for redis 6 ACL users.
+	Username string
+	Password string
+	// SentinelPassword authenticates with the sentinels, they don't share the redis password.
+	SentinelPassword string
+	// TLS is read from redis.<name>.tls.*, nil when the connection is plain.
+	TLS *tls.Config
+	// SentinelTLS is read from redis.<name>.sentinel_tls.*, the sentinels may not use
+	// the certificates of the redis behind them.
+	SentinelTLS *tls.Config
+}
+
+type redisPool struct {
+	cfg    RedisPoolConfig
+	dial   func() (redisClient, error)
+	tokens chan struct{}
+	lock   sync.Mutex
+	idle   []idleRedisConn
+	closed bool
+	// generation changes on reset, older connections are closed when put back.
+	generation int
+	// instrument times the commands of the connections lent out.
+	instrument instrument
+}
+
+type idleRedisConn struct {
+	conn       redisClient
+	since      time.Time
+	generation int
+}
+
+type pooledRedis struct {
+	redisClient
+	generation int
+}
+
+// trackedRedis remembers whether a command failed on the connection itself, a network
+// or protocol error, rather than with an error reply from redis.
+type trackedRedis struct {
+	conn   RedisConn
+	broken bool
+}
+
+func (tracked *trackedRedis) Cmd(cmd string, args ...interface{}) *redis.Reply {
+	reply := tracked.conn.Cmd(cmd, args...)
+	if reply.Type == redis.ErrorReply {
+		if _, ok := reply.Err.(*redis.CmdError); !ok {
+			tracked.broken = true
+		}
+	}
+	return reply
+}
+
+// WithRedis runs fn with a connection from the default Redis pool.
+func (clients *clients) WithRedis(fn func(conn RedisConn) error) error {
+	return clients.WithNamedRedis("default", fn)
+}
+
+// WithNamedRedis runs fn with a connection from the clientName Redis pool and returns
+// the connection when fn is done. A connection that failed with a network or protocol
+// error is closed rather than reused, error replies and the errors fn returns keep it.
+// Commands are timed as redis.<name>.<COMMAND>.
+func (clients *clients) WithNamedRedis(clientName string, fn func(conn RedisConn) error) error {
+	pool, err := clients.redisPool(clientName)
+	if err != nil {
+		return err
+	}
+	return pool.with(func(conn RedisConn) error {
+		return fn(&instrumentedRedis{conn: conn, instrument: pool.instrument})
+	})
+}
+
+func (clients *clients) redisPool(clientName string) (*redisPool, error) {
+	created, err := clients.redisPools.get(clientName, func() (interface{}, error) {
+		cfg, err := redisPoolConfig(clientName)
+		if err != nil {
+			return nil, err
+		}
+		pool := newRedisPool(cfg, func() (redisClient, error) {
+			// read again so new connections use refreshed secrets
+			cfg, err := redisPoolConfig(clientName)
+			if err != nil {
+				return nil, err
+			}
+			return dialPooledRedis(clientName, cfg)
+		})
+		clients.watchRedisMaster(clientName)
+		pool.instrument = newInstrument("redis", clientName)
+		return pool, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created.(*redisPool), nil
+}
+
+func redisPoolConfig(clientName string) (RedisPoolConfig, error) {
+	tlsCfg, err := tlsConfig(fmt.Sprintf("redis.%s", clientName))
+	if err != nil {
+		return RedisPoolConfig{}, err
+	}
+	password, err := configSecret(fmt.Sprintf("redis.%s.password", clientName))
+	if err != nil {
+		return RedisPoolConfig{}, err
+	}
+	sentinelPassword, err := configSecret(fmt.Sprintf("redis.%s.sentinel_password", clientName))
+	if err != nil {
+		return RedisPoolConfig{}, err
+	}
+	sentinelTLS, err := buildTLSConfig(tlsSectionOptions(fmt.Sprintf("redis.%s.sentinel_tls", clientName)))
+	if err != nil {
+		return RedisPoolConfig{}, err
+	}
+	return RedisPoolConfig{
+		Size:             config.GetInt(fmt.Sprintf("redis.%s.pool_size", clientName), 10),
+		PoolTimeout:      configDuration(fmt.Sprintf("redis.%s.pool_timeout", clientName), "5s"),
+		IdleTimeout:      configDuration(fmt.Sprintf("redis.%s.idle_timeout", clientName), "5m"),
+		DialTimeout:      configDuration(fmt.Sprintf("redis.%s.dial_timeout", clientName), "5s"),
+		ReadTimeout:      configDuration(fmt.Sprintf("redis.%s.read_timeout", clientName), "0s"),
+		WriteTimeout:     configDuration(fmt.Sprintf("redis.%s.write_timeout", clientName), "0s"),
+		Username:         config.Get(fmt.Sprintf("redis.%s.username", clientName), ""),
+		Password:         password,
+		SentinelPassword: sentinelPassword,
+		TLS:              tlsCfg,
+		SentinelTLS:      sentinelTLS,
+	}, nil
+}
+
+// configDuration reads a duration such as 500ms or 5m from the config.
+func configDuration(key string, defaultValue string) time.Duration {
+	value := config.Get(key, defaultValue)
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("Invalid duration %s for %s", value, key)))
+		duration, _ = time.ParseDuration(defaultValue)
+	}
+	return duration
+}
+
+func newRedisPool(cfg RedisPoolConfig, dial func() (redisClient, error)) *redisPool {
+	if cfg.Size < 1 {
+		cfg.Size = 1
+	}
+	return &redisPool{
+		cfg:    cfg,
+		dial:   dial,
+		tokens: make(chan struct{}, cfg.Size),
+	}
+}
+
+func (pool *redisPool) with(fn func(conn RedisConn) error) error {
+	conn, err := pool.get()
+	if err != nil {
+		return err
+	}
+	tracked := &trackedRedis{conn: conn.redisClient}
+	defer func() {
+		// a connection fn panicked with may be half way through a command
+		if recovered := recover(); recovered != nil {
+			pool.put(conn, true)
+			panic(recovered)
+		}
+	}()
+	err = fn(tracked)
+	pool.put(conn, tracked.broken)
+	return err
+}
+
+func (pool *redisPool) get() (pooledRedis, error) {
+	if err := pool.acquire(); err != nil {
+		return pooledRedis{}, err
+	}
+
+	pool.lock.Lock()
+	for len(pool.idle) > 0 {
+		last := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if pool.cfg.IdleTimeout > 0 && time.Since(last.since) > pool.cfg.IdleTimeout {
+			last.conn.Close()
+			continue
+		}
+		pool.lock.Unlock()
+		return pooledRedis{last.conn, last.generation}, nil
+	}
+	generation := pool.generation
+	pool.lock.Unlock()
+
+	conn, err := pool.dial()
+	if err != nil {
+		<-pool.tokens
+		return pooledRedis{}, err
+	}
+	return pooledRedis{conn, generation}, nil
+}
+
+// acquire waits for a free connection slot, up to PoolTimeout.
+func (pool *redisPool) acquire() error {
+	if pool.cfg.PoolTimeout <= 0 {
+		pool.tokens <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(pool.cfg.PoolTimeout)
+	defer timer.Stop()
+	select {
+	case pool.tokens <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errors.Newf("Timed out after %s waiting for a redis connection, all %d are in use", pool.cfg.PoolTimeout, pool.cfg.Size)
+	}
+}
+
+func (pool *redisPool) put(conn pooledRedis, broken bool) {
+	defer func() { <-pool.tokens }()
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if broken || pool.closed || conn.generation != pool.generation {
+		conn.Close()
+		return
+	}
+	pool.idle = append(pool.idle, idleRedisConn{conn: conn.redisClient, since: time.Now(), generation: conn.generation})
+}
+
+// reset drops every connection, e.g. after a failover moved the master elsewhere.
+func (pool *redisPool) reset() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.generation++
+	for _, idle := range pool.idle {
+		idle.conn.Close()
+	}
+	pool.idle = nil
+}
+
+// close closes the idle connections, the ones in use are closed when they are put back.
+func (pool *redisPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.closed = true
+	for _, idle := range pool.idle {
+		idle.conn.Close()
+	}
+	pool.idle = nil
+}
+
+// dialPooledRedis connects clientName for the pool. Cluster connections are a client
+// for the whole cluster.
+func dialPooledRedis(clientName string, cfg RedisPoolConfig) (redisClient, error) {
+	topology := redisTopologyConfig(clientName)
+	if topology.mode == redisCluster {
+		return dialRedisCluster(topology, cfg)
+	}
+	return dialRedisTimeout(clientName, cfg)
+}
+
+// dialRedisTimeout connects to the standalone redis of clientName, or to its current
+// master when it is behind sentinel.
+func dialRedisTimeout(clientName string, cfg RedisPoolConfig) (*redis.Client, error) {
+	addr, err := redisAddress(clientName, redisTopologyConfig(clientName), cfg)
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return nil, err
+	}
+	return dialRedisAddress(addr, cfg)
+}
+
+func dialRedisAddress(addr string, cfg RedisPoolConfig) (*redis.Client, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	if cfg.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return nil, err
+	}
+	client := redis.NewClient(&timeoutConn{Conn: conn, read: cfg.ReadTimeout, write: cfg.WriteTimeout})
+
+	if cfg.Password != "" {
+		args := []interface{}{cfg.Password}
+		if cfg.Username != "" {
+			args = []interface{}{cfg.Username, cfg.Password}
+		}
+		if err := client.Cmd("AUTH", args...).Err; err != nil {
+			client.Close()
+			err = errors.Wrap(err, fmt.Sprintf("Couldn't authenticate with redis %s", addr))
+			logger.ErrorLog(err)
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// timeoutConn sets a deadline before every read and write.
+type timeoutConn struct {
+	net.Conn
+	read  time.Duration
+	write time.Duration
+}
+
+func (conn *timeoutConn) Read(b []byte) (int, error) {
+	if conn.read > 0 {
+		conn.Conn.SetReadDeadline(time.Now().Add(conn.read))
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *timeoutConn) Write(b []byte) (int, error) {
+	if conn.write > 0 {
+		conn.Conn.SetWriteDeadline(time.Now().Add(conn.write))
+	}
+	return conn.Conn.Write(b)
+}
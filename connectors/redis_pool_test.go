@@ -0,0 +1,187 @@
+package connectors
+
+import (
+	"errors"
+	"github.com/fzzy/radix/redis"
+	"testing"
+	"time"
+)
+
+type fakeRedis struct {
+	closed bool
+	// reply is what every command gets, an empty reply when nil
+	reply *redis.Reply
+}
+
+func (conn *fakeRedis) Cmd(cmd string, args ...interface{}) *redis.Reply {
+	if conn.reply != nil {
+		return conn.reply
+	}
+	return &redis.Reply{}
+}
+
+func (conn *fakeRedis) Close() error {
+	conn.closed = true
+	return nil
+}
+
+func TestRedisPoolReusesConnections(t *testing.T) {
+	dialed := 0
+	pool := newRedisPool(RedisPoolConfig{Size: 2}, func() (redisClient, error) {
+		dialed++
+		return &fakeRedis{}, nil
+	})
+
+	var first, second RedisConn
+	pool.with(func(conn RedisConn) error {
+		first = conn.(*trackedRedis).conn
+		return nil
+	})
+	pool.with(func(conn RedisConn) error {
+		second = conn.(*trackedRedis).conn
+		return nil
+	})
+	if dialed != 1 || first != second {
+		t.Errorf("Expected the connection to be reused, dialed %d", dialed)
+	}
+
+	// errors of the caller and error replies don't break the connection
+	pool.with(func(conn RedisConn) error { return errors.New("order not found") })
+	first.(*fakeRedis).reply = &redis.Reply{Type: redis.ErrorReply, Err: &redis.CmdError{Err: errors.New("WRONGTYPE")}}
+	pool.with(func(conn RedisConn) error { return conn.Cmd("GET", "order").Err })
+	if first.(*fakeRedis).closed || dialed != 1 {
+		t.Errorf("Expected the connection to be kept, dialed %d", dialed)
+	}
+
+	first.(*fakeRedis).reply = &redis.Reply{Type: redis.ErrorReply, Err: errors.New("broken pipe")}
+	pool.with(func(conn RedisConn) error {
+		conn.Cmd("GET", "order")
+		return nil
+	})
+	if !first.(*fakeRedis).closed {
+		t.Errorf("Expected a failed connection to be closed")
+	}
+	pool.with(func(conn RedisConn) error { return nil })
+	if dialed != 2 {
+		t.Errorf("Expected a new connection after a failure, dialed %d", dialed)
+	}
+}
+
+func TestRedisPoolReturnsConnectionOnPanic(t *testing.T) {
+	dialed := []*fakeRedis{}
+	pool := newRedisPool(RedisPoolConfig{Size: 1, PoolTimeout: 10 * time.Millisecond}, func() (redisClient, error) {
+		conn := &fakeRedis{}
+		dialed = append(dialed, conn)
+		return conn, nil
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to go on")
+			}
+		}()
+		pool.with(func(conn RedisConn) error { panic("boom") })
+	}()
+	if err := pool.with(func(conn RedisConn) error { return nil }); err != nil {
+		t.Fatalf("Expected the slot to be free again, got %v", err)
+	}
+	if !dialed[0].closed || len(dialed) != 2 {
+		t.Errorf("Expected the connection to be closed and replaced, dialed %d", len(dialed))
+	}
+}
+
+func TestRedisPoolTimesOut(t *testing.T) {
+	pool := newRedisPool(RedisPoolConfig{Size: 1, PoolTimeout: 10 * time.Millisecond}, func() (redisClient, error) {
+		return &fakeRedis{}, nil
+	})
+	release := make(chan bool)
+	go pool.with(func(conn RedisConn) error {
+		<-release
+		return nil
+	})
+	defer close(release)
+	time.Sleep(5 * time.Millisecond)
+
+	if err := pool.with(func(conn RedisConn) error { return nil }); err == nil {
+		t.Error("Expected to time out waiting for the busy connection")
+	}
+}
+
+func TestRedisPoolLimitsSize(t *testing.T) {
+	pool := newRedisPool(RedisPoolConfig{Size: 1}, func() (redisClient, error) {
+		return &fakeRedis{}, nil
+	})
+	release := make(chan bool)
+	go pool.with(func(conn RedisConn) error {
+		<-release
+		return nil
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		pool.with(func(conn RedisConn) error { return nil })
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the second caller to wait for a free connection")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release <- true
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second caller to get the released connection")
+	}
+}
+
+func TestRedisPoolDropsIdleConnections(t *testing.T) {
+	dialed := 0
+	pool := newRedisPool(RedisPoolConfig{Size: 1, IdleTimeout: time.Millisecond}, func() (redisClient, error) {
+		dialed++
+		return &fakeRedis{}, nil
+	})
+	pool.with(func(conn RedisConn) error { return nil })
+	time.Sleep(5 * time.Millisecond)
+	pool.with(func(conn RedisConn) error { return nil })
+	if dialed != 2 {
+		t.Errorf("Expected the idle connection to be replaced, dialed %d", dialed)
+	}
+}
+
+func TestRedisPoolResetDropsConnections(t *testing.T) {
+	dialed := []*fakeRedis{}
+	pool := newRedisPool(RedisPoolConfig{Size: 2}, func() (redisClient, error) {
+		conn := &fakeRedis{}
+		dialed = append(dialed, conn)
+		return conn, nil
+	})
+	pool.with(func(conn RedisConn) error { return nil })
+
+	// a failover while a connection is in use
+	pool.with(func(conn RedisConn) error {
+		pool.reset()
+		return nil
+	})
+	if !dialed[0].closed {
+		t.Errorf("Expected the connection to the old master to be closed")
+	}
+	pool.with(func(conn RedisConn) error { return nil })
+	if len(dialed) != 2 {
+		t.Errorf("Expected a connection to the new master, dialed %d", len(dialed))
+	}
+}
+
+func TestSplitAddresses(t *testing.T) {
+	addresses := splitAddresses(" sentinel1:26379, sentinel2:26379,,")
+	if len(addresses) != 2 || addresses[0] != "sentinel1:26379" || addresses[1] != "sentinel2:26379" {
+		t.Errorf("Unexpected addresses %v", addresses)
+	}
+}
+
+func TestRedisClusterRejectsPassword(t *testing.T) {
+	if _, err := dialRedisCluster(redisTopology{nodes: []string{"node1:7000"}}, RedisPoolConfig{Password: "secret"}); err == nil {
+		t.Error("Expected a cluster with a password to be rejected")
+	}
+}
@@ -0,0 +1,198 @@
+package connectors
+
+import (
+	"fmt"
+	"github.com/fzzy/radix/extra/cluster"
+	"github.com/fzzy/radix/redis"
+	"net"
+	"strings"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+const (
+	redisStandalone = "standalone"
+	redisSentinel   = "sentinel"
+	redisCluster    = "cluster"
+)
+
+// redisTopology is where a named redis lives, from redis.<name>.mode:
+//
+//	standalone - redis.<name>.host and port
+//	sentinel   - redis.<name>.master, the master name, and redis.<name>.sentinels
+//	cluster    - redis.<name>.nodes, some of the cluster nodes to discover it from
+//
+// Addresses are comma separated host:port lists.
+type redisTopology struct {
+	mode      string
+	addr      string
+	master    string
+	sentinels []string
+	nodes     []string
+}
+
+func redisTopologyConfig(clientName string) redisTopology {
+	key := func(option string) string {
+		return fmt.Sprintf("redis.%s.%s", clientName, option)
+	}
+	return redisTopology{
+		mode:      config.Get(key("mode"), redisStandalone),
+		addr:      fmt.Sprintf("%s:%d", config.Get(key("host"), "localhost"), config.GetInt(key("port"), 6379)),
+		master:    config.Get(key("master"), "mymaster"),
+		sentinels: splitAddresses(config.Get(key("sentinels"), "")),
+		nodes:     splitAddresses(config.Get(key("nodes"), "")),
+	}
+}
+
+func splitAddresses(list string) []string {
+	addresses := []string{}
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// singleRedis fails if clientName is a cluster, NamedRedis and NewRedisConnection
+// return a connection to a single redis.
+func singleRedis(clientName string) error {
+	if redisTopologyConfig(clientName).mode == redisCluster {
+		return errors.Newf("Redis %s is a cluster, it can't be used with NamedRedis or NewRedisConnection, use WithNamedRedis", clientName)
+	}
+	return nil
+}
+
+// redisAddress returns the address to connect to, asking the sentinels where the
+// master is now.
+func redisAddress(clientName string, topology redisTopology, cfg RedisPoolConfig) (string, error) {
+	switch topology.mode {
+	case redisStandalone:
+		return topology.addr, nil
+	case redisSentinel:
+		return sentinelMaster(topology.sentinels, topology.master, cfg)
+	case redisCluster:
+		return "", errors.Newf("Redis %s is a cluster, use WithNamedRedis", clientName)
+	}
+	return "", errors.Newf("Unknown redis mode %s for %s", topology.mode, clientName)
+}
+
+// sentinelMaster asks the sentinels in order for the address of master, the first
+// one to answer wins. Sentinels are dialed with the sentinel password and TLS config.
+func sentinelMaster(sentinels []string, master string, cfg RedisPoolConfig) (string, error) {
+	cfg.Username = ""
+	cfg.Password = cfg.SentinelPassword
+	cfg.TLS = cfg.SentinelTLS
+	if len(sentinels) == 0 {
+		return "", errors.Newf("No sentinels configured for redis master %s", master)
+	}
+	var lastErr error
+	for _, addr := range sentinels {
+		client, err := dialRedisAddress(addr, cfg)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := client.Cmd("SENTINEL", "get-master-addr-by-name", master).List()
+		client.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = errors.Newf("Sentinel %s doesn't know master %s", addr, master)
+			continue
+		}
+		return net.JoinHostPort(reply[0], reply[1]), nil
+	}
+	return "", errors.Wrap(lastErr, fmt.Sprintf("Couldn't find redis master %s", master))
+}
+
+// clusterConn is a client for the whole cluster, it follows MOVED and ASK redirects.
+type clusterConn struct {
+	*cluster.Cluster
+}
+
+func (conn clusterConn) Close() error {
+	conn.Cluster.Close()
+	return nil
+}
+
+// dialRedisCluster connects to the cluster through the first of its nodes that answers.
+// The cluster client dials the other nodes itself, in plain text and without AUTH, so
+// TLS and passwords can't be used with clusters. dial_timeout limits every network
+// operation on them.
+func dialRedisCluster(topology redisTopology, cfg RedisPoolConfig) (redisClient, error) {
+	if cfg.TLS != nil || cfg.Password != "" {
+		err := errors.New("Redis clusters can't be used with TLS or a password")
+		logger.ErrorLog(err)
+		return nil, err
+	}
+	var lastErr error = errors.New("No redis cluster nodes configured")
+	for _, node := range topology.nodes {
+		// every pooled connection is a cluster client, with a connection per node
+		c, err := cluster.NewClusterTimeout(node, cfg.DialTimeout)
+		if err == nil {
+			return clusterConn{c}, nil
+		}
+		lastErr = err
+	}
+	logger.ErrorLog(errors.Wrap(lastErr, lastErr.Error()))
+	return nil, lastErr
+}
+
+// watchRedisMaster follows the sentinels of clientName, once per name. When the master
+// moves the pool is reset and the shared client dropped, so the next WithNamedRedis or
+// NamedRedis connects to the new master. The config is read again on every check, so
+// a rotated sentinel password is picked up.
+func (clients *clients) watchRedisMaster(clientName string) {
+	topology := redisTopologyConfig(clientName)
+	if topology.mode != redisSentinel {
+		return
+	}
+	clients.redisWatchers.get(clientName, func() (interface{}, error) {
+		interval := configDuration(fmt.Sprintf("redis.%s.sentinel_check_interval", clientName), "1s")
+		current, _ := currentRedisMaster(clientName)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-clients.stop:
+					return
+				case <-ticker.C:
+				}
+				addr, err := currentRedisMaster(clientName)
+				if err != nil || addr == current {
+					continue
+				}
+				fmt.Printf("Redis %s master moved from %s to %s\n", clientName, current, addr)
+				current = addr
+				clients.redisFailover(clientName)
+			}
+		}()
+		return current, nil
+	})
+}
+
+// currentRedisMaster asks the sentinels of clientName where its master is, with the
+// config as it is now.
+func currentRedisMaster(clientName string) (string, error) {
+	cfg, err := redisPoolConfig(clientName)
+	if err != nil {
+		return "", err
+	}
+	topology := redisTopologyConfig(clientName)
+	return sentinelMaster(topology.sentinels, topology.master, cfg)
+}
+
+func (clients *clients) redisFailover(clientName string) {
+	if pool, ok := clients.redisPools.find(clientName); ok {
+		pool.(*redisPool).reset()
+	}
+	// callers still holding the shared client get errors from the closed connection
+	if client, ok := clients.redisClients.remove(clientName).(*redis.Client); ok {
+		client.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package connectors
+
+import (
+	"sort"
+	"sync"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// registry holds named clients of one kind. It is safe for concurrent use and creates
+// each client once: concurrent first calls for the same name wait for a single create.
+type registry struct {
+	sync.Mutex
+	clients map[string]interface{}
+	pending map[string]*pendingClient
+}
+
+type pendingClient struct {
+	done   chan struct{}
+	client interface{}
+	err    error
+}
+
+func newRegistry() *registry {
+	return &registry{
+		clients: map[string]interface{}{},
+		pending: map[string]*pendingClient{},
+	}
+}
+
+// get returns the client registered under name, calling create if there is none yet.
+// A failed create isn't remembered, the next call tries again. A create that panics
+// fails with an error, for this call and the ones waiting for it.
+func (r *registry) get(name string, create func() (interface{}, error)) (interface{}, error) {
+	r.Lock()
+	if client, ok := r.clients[name]; ok {
+		r.Unlock()
+		return client, nil
+	}
+	if pending, ok := r.pending[name]; ok {
+		r.Unlock()
+		<-pending.done
+		return pending.client, pending.err
+	}
+	pending := &pendingClient{done: make(chan struct{})}
+	r.pending[name] = pending
+	r.Unlock()
+
+	r.create(name, pending, create)
+	return pending.client, pending.err
+}
+
+func (r *registry) create(name string, pending *pendingClient, create func() (interface{}, error)) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			pending.client, pending.err = nil, errors.Newf("Creating client %s panicked: %v", name, recovered)
+		}
+		r.Lock()
+		delete(r.pending, name)
+		if pending.err == nil {
+			r.clients[name] = pending.client
+		}
+		r.Unlock()
+		close(pending.done)
+	}()
+	pending.client, pending.err = create()
+}
+
+// find returns the client registered under name without creating it.
+func (r *registry) find(name string) (interface{}, bool) {
+	r.Lock()
+	defer r.Unlock()
+	client, ok := r.clients[name]
+	return client, ok
+}
+
+// remove forgets the client registered under name and returns it, e.g. to close it.
+func (r *registry) remove(name string) interface{} {
+	r.Lock()
+	defer r.Unlock()
+	client := r.clients[name]
+	delete(r.clients, name)
+	return client
+}
+
+// each calls fn for every registered client, in name order.
+func (r *registry) each(fn func(name string, client interface{})) {
+	r.Lock()
+	names := make([]string, 0, len(r.clients))
+	for name := range r.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clients := make([]interface{}, len(names))
+	for i, name := range names {
+		clients[i] = r.clients[name]
+	}
+	r.Unlock()
+
+	for i, name := range names {
+		fn(name, clients[i])
+	}
+}
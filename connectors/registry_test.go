@@ -0,0 +1,76 @@
+package connectors
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryCreatesOnce(t *testing.T) {
+	r := newRegistry()
+	var created int32
+	create := func() (interface{}, error) {
+		atomic.AddInt32(&created, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &struct{}{}, nil
+	}
+
+	results := make([]interface{}, 20)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = r.get("default", create)
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("Expected a single client to be created but got %d", created)
+	}
+	for _, client := range results {
+		if client != results[0] {
+			t.Fatalf("Expected every caller to get the same client")
+		}
+	}
+}
+
+func TestRegistryRetriesFailedCreate(t *testing.T) {
+	r := newRegistry()
+	if _, err := r.get("default", func() (interface{}, error) { return nil, errors.New("down") }); err == nil {
+		t.Fatal("Expected the create error")
+	}
+	client, err := r.get("default", func() (interface{}, error) { return "client", nil })
+	if err != nil || client != "client" {
+		t.Errorf("Expected a new client after a failure, got %v %v", client, err)
+	}
+}
+
+func TestRegistryRecoversPanickingCreate(t *testing.T) {
+	r := newRegistry()
+	started := make(chan bool)
+	waiter := make(chan error)
+	go func() {
+		_, err := r.get("default", func() (interface{}, error) {
+			close(started)
+			time.Sleep(10 * time.Millisecond)
+			panic("bad config")
+		})
+		waiter <- err
+	}()
+	<-started
+	// waits for the create that panics
+	if _, err := r.get("default", func() (interface{}, error) { return "other", nil }); err == nil {
+		t.Error("Expected the waiting caller to get the panic as an error")
+	}
+	if err := <-waiter; err == nil {
+		t.Error("Expected the panic as an error")
+	}
+	client, err := r.get("default", func() (interface{}, error) { return "client", nil })
+	if err != nil || client != "client" {
+		t.Errorf("Expected a new client after a panic, got %v %v", client, err)
+	}
+}
@@ -0,0 +1,196 @@
+package connectors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// ReplicatedDB sends writes and transactions to the primary and spreads reads over
+// the healthy replicas, falling back to the primary when there is none.
+type ReplicatedDB struct {
+	Primary  *sql.DB
+	replicas []*replica
+	next     uint64
+}
+
+type replica struct {
+	name    string
+	lock    sync.Mutex
+	db      *sql.DB
+	healthy bool
+}
+
+// ReplicatedMySql returns the default MySql connection with its replicas.
+func (clients *clients) ReplicatedMySql() (*ReplicatedDB, error) {
+	return clients.NamedReplicatedMySql("default")
+}
+
+// NamedReplicatedMySql returns clientName with its replicas, listed as other MySql
+// connection names in mysql.<name>.replicas, e.g. "default_replica1,default_replica2".
+// Replicas are pinged every mysql.<name>.replica_check_interval and get no reads while
+// they fail.
+func (clients *clients) NamedReplicatedMySql(clientName string) (*ReplicatedDB, error) {
+	created, err := clients.replicatedClients.get(clientName, func() (interface{}, error) {
+		primary, err := clients.NamedMySql(clientName)
+		if err != nil {
+			return nil, err
+		}
+		db := &ReplicatedDB{Primary: primary}
+		for _, name := range strings.Split(config.Get(fmt.Sprintf("mysql.%s.replicas", clientName), ""), ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			r := &replica{name: name}
+			r.connect(clients)
+			db.replicas = append(db.replicas, r)
+		}
+		if len(db.replicas) > 0 {
+			interval := configDuration(fmt.Sprintf("mysql.%s.replica_check_interval", clientName), "5s")
+			go db.checkReplicas(clients, interval, clients.stop)
+		}
+		return db, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created.(*ReplicatedDB), nil
+}
+
+// Reader returns the next healthy replica, or the primary if none is healthy.
+func (db *ReplicatedDB) Reader() *sql.DB {
+	count := uint64(len(db.replicas))
+	for i := uint64(0); i < count; i++ {
+		r := db.replicas[atomic.AddUint64(&db.next, 1)%count]
+		if conn := r.healthyDB(); conn != nil {
+			return conn
+		}
+	}
+	return db.Primary
+}
+
+// Query runs a read on a replica. If the replica fails to answer it is taken out of
+// rotation and the query is retried on the primary.
+func (db *ReplicatedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *ReplicatedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	reader := db.Reader()
+	rows, err := reader.QueryContext(ctx, query, args...)
+	if err != nil && reader != db.Primary && ctx.Err() == nil && db.markFailed(reader, err) {
+		return db.Primary.QueryContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+// QueryRow runs a read on a replica. Errors are only known when scanning, so unlike
+// Query it doesn't fall back to the primary.
+func (db *ReplicatedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.Reader().QueryRow(query, args...)
+}
+
+func (db *ReplicatedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.Reader().QueryRowContext(ctx, query, args...)
+}
+
+func (db *ReplicatedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.Primary.Exec(query, args...)
+}
+
+func (db *ReplicatedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.Primary.ExecContext(ctx, query, args...)
+}
+
+// Begin starts a transaction on the primary, reads inside it see its writes.
+func (db *ReplicatedDB) Begin() (*sql.Tx, error) {
+	return db.Primary.Begin()
+}
+
+func (db *ReplicatedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return db.Primary.BeginTx(ctx, opts)
+}
+
+// markFailed takes the replica conn belongs to out of rotation if err means the
+// replica itself is down rather than a bad query.
+func (db *ReplicatedDB) markFailed(conn *sql.DB, err error) bool {
+	pingCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if conn.PingContext(pingCtx) == nil {
+		return false
+	}
+	for _, r := range db.replicas {
+		if r.healthyDB() == conn {
+			logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("MySql replica %s is down", r.name)))
+			r.setHealthy(false)
+		}
+	}
+	return true
+}
+
+func (db *ReplicatedDB) checkReplicas(clients *clients, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, r := range db.replicas {
+				r.check(clients, interval)
+			}
+		}
+	}
+}
+
+// connect opens the replica, a replica that is down at startup is retried by the checks.
+func (r *replica) connect(clients *clients) {
+	conn, err := clients.NamedMySql(r.name)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.db = conn
+	r.healthy = err == nil
+}
+
+func (r *replica) check(clients *clients, timeout time.Duration) {
+	r.lock.Lock()
+	conn := r.db
+	r.lock.Unlock()
+	if conn == nil {
+		r.connect(clients)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := conn.PingContext(ctx)
+	if err != nil && r.healthyDB() != nil {
+		logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("MySql replica %s is down", r.name)))
+	}
+	r.setHealthy(err == nil)
+}
+
+func (r *replica) healthyDB() *sql.DB {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.healthy {
+		return nil
+	}
+	return r.db
+}
+
+func (r *replica) setHealthy(healthy bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.healthy = healthy && r.db != nil
+}
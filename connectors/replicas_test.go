@@ -0,0 +1,50 @@
+package connectors
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func openLazy(t *testing.T, name string) *sql.DB {
+	// sql.Open doesn't connect, good enough to tell the handles apart
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:1)/"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReaderRoundRobinsHealthyReplicas(t *testing.T) {
+	primary := openLazy(t, "primary")
+	first := &replica{name: "first", db: openLazy(t, "first"), healthy: true}
+	second := &replica{name: "second", db: openLazy(t, "second"), healthy: true}
+	db := &ReplicatedDB{Primary: primary, replicas: []*replica{first, second}}
+
+	seen := map[*sql.DB]int{}
+	for i := 0; i < 4; i++ {
+		seen[db.Reader()]++
+	}
+	if seen[first.db] != 2 || seen[second.db] != 2 {
+		t.Errorf("Expected reads to be spread over the replicas, got %v", seen)
+	}
+
+	first.setHealthy(false)
+	for i := 0; i < 3; i++ {
+		if reader := db.Reader(); reader != second.db {
+			t.Fatalf("Expected reads to skip the unhealthy replica")
+		}
+	}
+
+	second.setHealthy(false)
+	if reader := db.Reader(); reader != primary {
+		t.Errorf("Expected reads to fall back to the primary")
+	}
+}
+
+func TestReaderWithoutReplicasUsesPrimary(t *testing.T) {
+	primary := openLazy(t, "primary")
+	db := &ReplicatedDB{Primary: primary}
+	if db.Reader() != primary {
+		t.Errorf("Expected the primary")
+	}
+}
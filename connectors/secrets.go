@@ -0,0 +1,243 @@
+package connectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// SecretProvider looks secrets up, e.g. in the environment or in Vault.
+type SecretProvider interface {
+	Secret(ref string) (string, error)
+}
+
+// EnvProvider reads secrets from environment variables, ref is the variable name.
+type EnvProvider struct{}
+
+func (EnvProvider) Secret(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", errors.Newf("Environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+// FileProvider reads secrets from files, such as the ones Kubernetes mounts. ref is
+// the path, a trailing newline is dropped.
+type FileProvider struct{}
+
+func (FileProvider) Secret(ref string) (string, error) {
+	content, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("Couldn't read secret file %s", ref))
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// VaultProvider reads secrets from the Vault HTTP API, ref is path#field, e.g.
+// secret/data/mysql#password. Both KV versions are understood.
+type VaultProvider struct {
+	Address string
+	Token   string
+	// TokenSource, if set, is asked for the token on every request instead of Token,
+	// e.g. to read a token file that is renewed.
+	TokenSource func() (string, error)
+	Client      *http.Client
+}
+
+// NewVaultProvider returns a provider for the Vault at address, e.g. https://vault:8200.
+func NewVaultProvider(address string, token string) *VaultProvider {
+	return &VaultProvider{
+		Address: strings.TrimRight(address, "/"),
+		Token:   token,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (vault *VaultProvider) Secret(ref string) (string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 {
+		return "", errors.Newf("Vault secret %s should be path#field", ref)
+	}
+	path, field := strings.TrimLeft(parts[0], "/"), parts[1]
+
+	token := vault.Token
+	if vault.TokenSource != nil {
+		var err error
+		if token, err = vault.TokenSource(); err != nil {
+			return "", errors.Wrap(err, "Couldn't read the vault token")
+		}
+	}
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s", vault.Address, path), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Couldn't build vault request")
+	}
+	request.Header.Set("X-Vault-Token", token)
+	response, err := vault.Client.Do(request)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("Couldn't read vault secret %s", path))
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.Newf("Vault answered %d for secret %s", response.StatusCode, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("Couldn't parse vault secret %s", path))
+	}
+	data := body.Data
+	// KV version 2 nests the secret under data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", errors.Newf("Vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+var (
+	secretsLock     sync.Mutex
+	secretProviders = map[string]SecretProvider{
+		"env":  EnvProvider{},
+		"file": FileProvider{},
+	}
+	// knownSecretSchemes are references even before their provider is registered,
+	// e.g. vault without vault.address, so they fail rather than become passwords.
+	knownSecretSchemes = map[string]bool{"env": true, "file": true, "vault": true}
+	secretValues       = map[string]string{}
+)
+
+// RegisterSecretProvider lets config values written as <scheme>:<ref> be looked up by
+// provider. env and file are registered already, vault is when vault.address is set.
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secretProviders[scheme] = provider
+	knownSecretSchemes[scheme] = true
+}
+
+// configSecret reads a credential from the config. Values like env:MYSQL_PASSWORD or
+// vault:secret/data/mysql#password are looked up by their provider and cached until
+// the next refresh, anything else is used as is. A vault reference without vault.address
+// is an error rather than a password.
+func configSecret(key string) (string, error) {
+	return resolveSecret(config.Get(key, ""))
+}
+
+func resolveSecret(value string) (string, error) {
+	secretsLock.Lock()
+	cached, found := secretValues[value]
+	secretsLock.Unlock()
+	if found {
+		return cached, nil
+	}
+
+	secret, isRef, err := lookupSecret(value)
+	if err != nil || !isRef {
+		return secret, err
+	}
+	secretsLock.Lock()
+	secretValues[value] = secret
+	secretsLock.Unlock()
+	return secret, nil
+}
+
+// lookupSecret asks the provider of value for it, without the cache. Values that
+// aren't references are returned as is.
+func lookupSecret(value string) (secret string, isRef bool, err error) {
+	provider, ref, isRef, err := secretProvider(value)
+	if err != nil || !isRef {
+		return value, false, err
+	}
+	secret, err = provider.Secret(ref)
+	return secret, true, err
+}
+
+func secretProvider(value string) (SecretProvider, string, bool, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, "", false, nil
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	provider, ok := secretProviders[parts[0]]
+	if !ok && knownSecretSchemes[parts[0]] {
+		return nil, "", false, errors.Newf("No %s secret provider is registered, e.g. vault needs vault.address", parts[0])
+	}
+	return provider, parts[1], ok, nil
+}
+
+// refreshSecrets looks every cached secret up again and returns the ones that changed,
+// by their config value. A secret that can't be looked up keeps its previous value.
+func refreshSecrets() map[string]bool {
+	secretsLock.Lock()
+	values := make(map[string]string, len(secretValues))
+	for value, secret := range secretValues {
+		values[value] = secret
+	}
+	secretsLock.Unlock()
+
+	changed := map[string]bool{}
+	for value, previous := range values {
+		secret, _, err := lookupSecret(value)
+		if err != nil {
+			logger.ErrorLog(errors.Wrap(err, "Couldn't refresh secret"))
+			continue
+		}
+		if secret == previous {
+			continue
+		}
+		secretsLock.Lock()
+		secretValues[value] = secret
+		secretsLock.Unlock()
+		changed[value] = true
+	}
+	return changed
+}
+
+// initSecrets registers the vault provider if vault.address is set and refreshes the
+// secrets every secrets.refresh_interval until stop is closed, calling rotated with
+// the ones that changed. The vault token is read again for every request, so a token
+// file that is renewed is picked up.
+func initSecrets(stop <-chan struct{}, rotated func(changed map[string]bool)) {
+	if address := config.Get("vault.address", ""); address != "" {
+		vault := NewVaultProvider(address, "")
+		tokenValue := config.Get("vault.token", "")
+		vault.TokenSource = func() (string, error) {
+			token, _, err := lookupSecret(tokenValue)
+			return token, err
+		}
+		RegisterSecretProvider("vault", vault)
+	}
+
+	interval := configDuration("secrets.refresh_interval", "5m")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if changed := refreshSecrets(); len(changed) > 0 {
+					rotated(changed)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,142 @@
+package connectors
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvAndFileProviders(t *testing.T) {
+	os.Setenv("GOFIVERR_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("GOFIVERR_TEST_SECRET")
+	if secret, err := resolveSecret("env:GOFIVERR_TEST_SECRET"); err != nil || secret != "s3cret" {
+		t.Errorf("Unexpected env secret %q %v", secret, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "password")
+	ioutil.WriteFile(path, []byte("from-file\n"), 0600)
+	if secret, err := resolveSecret("file:" + path); err != nil || secret != "from-file" {
+		t.Errorf("Unexpected file secret %q %v", secret, err)
+	}
+
+	if secret, _ := resolveSecret("plain-password"); secret != "plain-password" {
+		t.Errorf("Expected plain values to be used as is, got %q", secret)
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	password := "v1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/mysql":
+			fmt.Fprintf(w, `{"data":{"data":{"password":%q},"metadata":{"version":1}}}`, password)
+		case "/v1/kv/redis":
+			fmt.Fprint(w, `{"data":{"password":"redis-pass"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vault := NewVaultProvider(server.URL, "token")
+	if secret, err := vault.Secret("secret/data/mysql#password"); err != nil || secret != "v1" {
+		t.Errorf("Unexpected kv v2 secret %q %v", secret, err)
+	}
+	if secret, err := vault.Secret("kv/redis#password"); err != nil || secret != "redis-pass" {
+		t.Errorf("Unexpected kv v1 secret %q %v", secret, err)
+	}
+	if _, err := vault.Secret("secret/data/missing#password"); err == nil {
+		t.Errorf("Expected a missing secret to fail")
+	}
+	if _, err := NewVaultProvider(server.URL, "wrong").Secret("secret/data/mysql#password"); err == nil {
+		t.Errorf("Expected a bad token to fail")
+	}
+
+	// cached until refreshed
+	RegisterSecretProvider("testvault", vault)
+	ref := "testvault:secret/data/mysql#password"
+	resolveSecret(ref)
+	password = "v2"
+	if secret, _ := resolveSecret(ref); secret != "v1" {
+		t.Errorf("Expected the cached secret, got %q", secret)
+	}
+	if changed := refreshSecrets(); !changed[ref] {
+		t.Errorf("Expected the secret to be reported as rotated, got %v", changed)
+	}
+	if secret, _ := resolveSecret(ref); secret != "v2" {
+		t.Errorf("Expected the rotated secret, got %q", secret)
+	}
+	if changed := refreshSecrets(); changed[ref] {
+		t.Errorf("Expected an unchanged secret not to be reported, got %v", changed)
+	}
+}
+
+func TestVaultTokenIsReadAgain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "renewed" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"password":"p"}}`)
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(tokenFile, []byte("expired\n"), 0600)
+	vault := NewVaultProvider(server.URL, "")
+	vault.TokenSource = func() (string, error) {
+		token, _, err := lookupSecret("file:" + tokenFile)
+		return token, err
+	}
+	if _, err := vault.Secret("kv/app#password"); err == nil {
+		t.Fatal("Expected the expired token to be refused")
+	}
+	ioutil.WriteFile(tokenFile, []byte("renewed\n"), 0600)
+	if secret, err := vault.Secret("kv/app#password"); err != nil || secret != "p" {
+		t.Errorf("Expected the renewed token to be used, got %q %v", secret, err)
+	}
+}
+
+func TestUnregisteredSecretScheme(t *testing.T) {
+	secretsLock.Lock()
+	provider, registered := secretProviders["vault"]
+	delete(secretProviders, "vault")
+	secretsLock.Unlock()
+	defer func() {
+		if registered {
+			RegisterSecretProvider("vault", provider)
+		}
+	}()
+
+	if secret, err := resolveSecret("vault:secret/data/mysql#password"); err == nil {
+		t.Errorf("Expected a vault reference without vault.address to fail, got %q", secret)
+	}
+	if secret, err := resolveSecret("https://example.com"); err != nil || secret != "https://example.com" {
+		t.Errorf("Expected other values with a colon to be used as is, got %q %v", secret, err)
+	}
+}
+
+func TestRedactedDSN(t *testing.T) {
+	cfg := mysql.NewConfig()
+	cfg.User = "app"
+	cfg.Passwd = "s3cret"
+	cfg.Net = "tcp"
+	cfg.Addr = "db:3306"
+	dsn := redactedDSN(cfg)
+	if strings.Contains(dsn, "s3cret") || !strings.Contains(dsn, "app:****@tcp(db:3306)") {
+		t.Errorf("Unexpected DSN %s", dsn)
+	}
+	if cfg.Passwd != "s3cret" {
+		t.Errorf("Expected the config to be left alone")
+	}
+}
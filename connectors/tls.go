@@ -0,0 +1,73 @@
+package connectors
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// tlsOptions are read from <connection>.tls.* in the config, e.g. redis.cache.tls.ca_file.
+type tlsOptions struct {
+	enabled    bool
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	skipVerify bool
+}
+
+func tlsOptionsConfig(prefix string) tlsOptions {
+	return tlsSectionOptions(prefix + ".tls")
+}
+
+// tlsSectionOptions reads the TLS options under section, for connections with more
+// than one, e.g. redis.cache.sentinel_tls.*.
+func tlsSectionOptions(section string) tlsOptions {
+	key := func(option string) string {
+		return fmt.Sprintf("%s.%s", section, option)
+	}
+	return tlsOptions{
+		enabled:    config.Get(key("enabled"), "false") == "true",
+		caFile:     config.Get(key("ca_file"), ""),
+		certFile:   config.Get(key("cert_file"), ""),
+		keyFile:    config.Get(key("key_file"), ""),
+		serverName: config.Get(key("server_name"), ""),
+		skipVerify: config.Get(key("skip_verify"), "false") == "true",
+	}
+}
+
+// tlsConfig returns the TLS config of a connection, or nil when it doesn't use TLS.
+// skip_verify is only meant for development.
+func tlsConfig(prefix string) (*tls.Config, error) {
+	return buildTLSConfig(tlsOptionsConfig(prefix))
+}
+
+func buildTLSConfig(options tlsOptions) (*tls.Config, error) {
+	if !options.enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         options.serverName,
+		InsecureSkipVerify: options.skipVerify,
+	}
+	if options.caFile != "" {
+		pem, err := ioutil.ReadFile(options.caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Couldn't read CA file %s", options.caFile))
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Newf("No certificates found in CA file %s", options.caFile)
+		}
+	}
+	if options.certFile != "" || options.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.certFile, options.keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load client certificate %s", options.certFile))
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,182 @@
+// Package encryption seals sensitive events with AES-GCM before they are published,
+// so their params never travel through RabbitMQ, the outbox or the failed queue in
+// clear text.
+//
+// An encrypted event keeps its name in clear so it can be routed and dispatched,
+// everything else lives in the envelope:
+//
+//	{"event": "order_paid", "encrypted": {"key_id": "2016-05", "ciphertext": "<base64>"}}
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sync"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// EnvelopeKey is the event param holding the encrypted envelope.
+const EnvelopeKey = "encrypted"
+
+// Envelope is what an encrypted event carries instead of its params.
+type Envelope struct {
+	KeyID      string `json:"key_id"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keyring holds the keys events are encrypted with. New events are sealed with the
+// current key, older keys stay around to open events published before a rotation.
+type Keyring struct {
+	sync.RWMutex
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[string]cipher.AEAD{}}
+}
+
+// AddKey adds an AES key of 16, 24 or 32 bytes. The first key added becomes current.
+func (keyring *Keyring) AddKey(id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid key %s", id)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid key %s", id)
+	}
+	keyring.Lock()
+	defer keyring.Unlock()
+	keyring.keys[id] = aead
+	if keyring.current == "" {
+		keyring.current = id
+	}
+	return nil
+}
+
+// AddBase64Key is AddKey for keys kept base64 encoded in config or secrets.
+func (keyring *Keyring) AddBase64Key(id string, key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.Wrapf(err, "Key %s is not valid base64", id)
+	}
+	return keyring.AddKey(id, raw)
+}
+
+// Rotate makes id the key new events are encrypted with.
+func (keyring *Keyring) Rotate(id string) error {
+	keyring.Lock()
+	defer keyring.Unlock()
+	if _, ok := keyring.keys[id]; !ok {
+		return errors.Newf("Unknown key %s", id)
+	}
+	keyring.current = id
+	return nil
+}
+
+// Seal encrypts the params of eventName with the current key. The event name is
+// authenticated too, so an envelope can't be replayed as another event.
+func (keyring *Keyring) Seal(eventName string, params map[string]interface{}) (map[string]interface{}, error) {
+	plaintext, err := json.Marshal(params)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't marshal event")
+	}
+
+	keyring.RLock()
+	keyID := keyring.current
+	aead, ok := keyring.keys[keyID]
+	keyring.RUnlock()
+	if !ok {
+		return nil, errors.New("Keyring has no keys")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "Couldn't generate nonce")
+	}
+	envelope := Envelope{
+		KeyID:      keyID,
+		Ciphertext: aead.Seal(nonce, nonce, plaintext, additionalData(keyID, eventName)),
+	}
+	return map[string]interface{}{
+		"event":     eventName,
+		EnvelopeKey: envelope,
+	}, nil
+}
+
+// Open decrypts an encrypted event back to its params. Params that are not
+// encrypted are returned as they are.
+func (keyring *Keyring) Open(params map[string]interface{}) (map[string]interface{}, error) {
+	envelope, eventName, ok, err := ReadEnvelope(params)
+	if err != nil || !ok {
+		return params, err
+	}
+
+	keyring.RLock()
+	aead, found := keyring.keys[envelope.KeyID]
+	keyring.RUnlock()
+	if !found {
+		return nil, errors.Newf("Unknown key %s", envelope.KeyID)
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(envelope.Ciphertext) < nonceSize {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	nonce, ciphertext := envelope.Ciphertext[:nonceSize], envelope.Ciphertext[nonceSize:]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(envelope.KeyID, eventName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't decrypt event %s with key %s", eventName, envelope.KeyID)
+	}
+
+	var opened map[string]interface{}
+	if err := json.Unmarshal(plaintext, &opened); err != nil {
+		return nil, errors.Wrap(err, "Decrypted event is not valid JSON")
+	}
+	return opened, nil
+}
+
+// IsEncrypted tells whether params carry an encrypted envelope. Plain events may have
+// an "encrypted" param of their own, only an envelope with a key ID and a ciphertext
+// counts.
+func IsEncrypted(params map[string]interface{}) bool {
+	switch envelope := params[EnvelopeKey].(type) {
+	case Envelope, *Envelope:
+		return true
+	case map[string]interface{}:
+		_, hasKey := envelope["key_id"]
+		_, hasCiphertext := envelope["ciphertext"]
+		return hasKey && hasCiphertext
+	}
+	return false
+}
+
+// ReadEnvelope extracts the envelope from params decoded by encoding/json. ok is
+// false when the params are not encrypted.
+func ReadEnvelope(params map[string]interface{}) (envelope Envelope, eventName string, ok bool, err error) {
+	if !IsEncrypted(params) {
+		return envelope, "", false, nil
+	}
+	raw := params[EnvelopeKey]
+	eventName, _ = params["event"].(string)
+
+	// the envelope went through JSON as a map, take the same route back
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return envelope, eventName, true, errors.Wrap(err, "Invalid envelope")
+	}
+	if err = json.Unmarshal(data, &envelope); err != nil {
+		return envelope, eventName, true, errors.Wrap(err, "Invalid envelope")
+	}
+	return envelope, eventName, true, nil
+}
+
+func additionalData(keyID, eventName string) []byte {
+	return []byte(keyID + "|" + eventName)
+}
@@ -0,0 +1,111 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func roundTrip(t *testing.T, sealed map[string]interface{}) map[string]interface{} {
+	// events go through JSON on their way to the consumer
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestSealAndOpen(t *testing.T) {
+	keyring := NewKeyring()
+	if err := keyring.AddKey("k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]interface{}{"event": "order_paid", "card": "4111111111111111"}
+	sealed, err := keyring.Seal("order_paid", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := json.Marshal(sealed)
+	if bytes.Contains(encoded, []byte("4111")) {
+		t.Errorf("Expected the card number to be encrypted got %s", encoded)
+	}
+
+	opened, err := keyring.Open(roundTrip(t, sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened["card"] != "4111111111111111" || opened["event"] != "order_paid" {
+		t.Errorf("Unexpected params %v", opened)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.AddKey("old", bytes.Repeat([]byte{1}, 16))
+	sealedWithOld, _ := keyring.Seal("order_paid", map[string]interface{}{"amount": 5.0})
+
+	keyring.AddKey("new", bytes.Repeat([]byte{2}, 16))
+	if err := keyring.Rotate("new"); err != nil {
+		t.Fatal(err)
+	}
+	sealedWithNew, _ := keyring.Seal("order_paid", map[string]interface{}{"amount": 6.0})
+	if envelope := sealedWithNew[EnvelopeKey].(Envelope); envelope.KeyID != "new" {
+		t.Errorf("Expected the new key to be used got %s", envelope.KeyID)
+	}
+
+	for _, sealed := range []map[string]interface{}{sealedWithOld, sealedWithNew} {
+		if _, err := keyring.Open(roundTrip(t, sealed)); err != nil {
+			t.Errorf("Expected to open events of both keys got %s", err)
+		}
+	}
+	if err := keyring.Rotate("missing"); err == nil {
+		t.Error("Expected rotating to an unknown key to fail")
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.AddKey("k1", bytes.Repeat([]byte{1}, 32))
+	sealed, _ := keyring.Seal("order_paid", map[string]interface{}{"amount": 5.0})
+
+	// the same envelope presented as another event
+	decoded := roundTrip(t, sealed)
+	decoded["event"] = "order_refunded"
+	if _, err := keyring.Open(decoded); err == nil {
+		t.Error("Expected a renamed event to fail")
+	}
+
+	plain := map[string]interface{}{"event": "gig_viewed"}
+	if opened, err := keyring.Open(plain); err != nil || opened["event"] != "gig_viewed" {
+		t.Errorf("Expected clear events to pass through got %v %v", opened, err)
+	}
+}
+
+func TestIsEncryptedOnlyForEnvelopes(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.AddKey("k1", bytes.Repeat([]byte{1}, 32))
+	sealed, err := keyring.Seal("order_paid", map[string]interface{}{"event": "order_paid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || !IsEncrypted(roundTrip(t, sealed)) {
+		t.Error("Expected a sealed event to be encrypted, before and after JSON")
+	}
+
+	for _, plain := range []map[string]interface{}{
+		{"event": "gig_updated", "encrypted": false},
+		{"event": "gig_updated", "encrypted": map[string]interface{}{"at_rest": true}},
+		{"event": "gig_updated"},
+	} {
+		if IsEncrypted(plain) {
+			t.Errorf("Expected %v not to be encrypted", plain)
+		}
+		if _, _, ok, err := ReadEnvelope(plain); ok || err != nil {
+			t.Errorf("Expected no envelope in %v got %v, %v", plain, ok, err)
+		}
+	}
+}
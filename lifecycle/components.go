@@ -0,0 +1,73 @@
+package lifecycle
+
+import (
+	"context"
+	"github.com/adjust/goenv"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/statsd"
+	"github.com/roeepolegfiverr/gofiverr/worker"
+)
+
+// Names of the built in components, for DependsOn.
+const (
+	LoggerComponent     = "logger"
+	StatsDComponent     = "statsd"
+	ConnectorsComponent = "connectors"
+	WorkerComponent     = "worker"
+)
+
+// Logger sends logs to Graylog. There is nothing to close, logs are sent as they come.
+func Logger(host string, port int) Component {
+	return Component{
+		Name: LoggerComponent,
+		Start: func(ctx context.Context) error {
+			logger.InitLogger(host, port)
+			return nil
+		},
+	}
+}
+
+// StatsD sends metrics to statsd. Metrics are sent as they come over UDP, there is
+// nothing to close.
+func StatsD(host string, prefix string, port int) Component {
+	return Component{
+		Name:      StatsDComponent,
+		DependsOn: []string{LoggerComponent},
+		Start: func(ctx context.Context) error {
+			statsd.InitStatsD(host, prefix, port)
+			return nil
+		},
+	}
+}
+
+// Connectors initializes the connectors and closes every client they created.
+func Connectors(cfg *goenv.Goenv, initRabbit bool) Component {
+	return Component{
+		Name:      ConnectorsComponent,
+		DependsOn: []string{LoggerComponent, StatsDComponent},
+		Start: func(ctx context.Context) error {
+			connectors.InitConnectors(cfg, initRabbit)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			return connectors.Clients.Shutdown()
+		},
+	}
+}
+
+// Worker consumes queueName, see worker.Consume. Stopping it stops pulling messages
+// and waits up to drainTimeout for the jobs in flight.
+func Worker(queueName string, workerName string, routingKey string, workersInPool int, drainTimeout time.Duration) Component {
+	return Component{
+		Name:      WorkerComponent,
+		DependsOn: []string{ConnectorsComponent},
+		Timeout:   drainTimeout,
+		Start: func(ctx context.Context) error {
+			go worker.Consume(queueName, workerName, routingKey, workersInPool, nil)
+			return nil
+		},
+		Stop: worker.Drain,
+	}
+}
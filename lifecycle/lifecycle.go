@@ -0,0 +1,224 @@
+// Package lifecycle starts the parts of a service in dependency order and stops them
+// in reverse, each within a timeout. Connectors, statsd, the logger and workers are
+// registered as components, see components.go.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// DefaultTimeout limits the start and stop of components that don't set a Timeout.
+var DefaultTimeout = 10 * time.Second
+
+// Component is a part of the service with a start and a stop. Either may be nil.
+type Component struct {
+	Name string
+	// DependsOn names the components that must be started before this one and
+	// stopped after it.
+	DependsOn []string
+	Start     func(ctx context.Context) error
+	Stop      func(ctx context.Context) error
+	// Timeout limits Start and Stop, defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Manager starts and stops components.
+type Manager struct {
+	lock       sync.Mutex
+	components []*Component
+	started    []*Component
+}
+
+var manager = New()
+
+func New() *Manager {
+	return &Manager{}
+}
+
+// Register adds a component to the default manager.
+func Register(component Component) error {
+	return manager.Register(component)
+}
+
+// Start starts the components of the default manager.
+func Start(ctx context.Context) error {
+	return manager.Start(ctx)
+}
+
+// Stop stops the components of the default manager.
+func Stop(ctx context.Context) error {
+	return manager.Stop(ctx)
+}
+
+// Run starts the components of the default manager, waits for SIGINT, SIGTERM or ctx
+// to be done and stops them.
+func Run(ctx context.Context) error {
+	if err := Start(ctx); err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case sig := <-signals:
+		fmt.Printf("Got %s, shutting down\n", sig)
+	case <-ctx.Done():
+	}
+	return Stop(context.Background())
+}
+
+// Register adds a component. Names must be unique.
+func (m *Manager) Register(component Component) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, registered := range m.components {
+		if registered.Name == component.Name {
+			return errors.Newf("Component %s is already registered", component.Name)
+		}
+	}
+	m.components = append(m.components, &component)
+	return nil
+}
+
+// Start starts every component after its dependencies. If one fails to start, the
+// ones already started are stopped and its error is returned.
+func (m *Manager) Start(ctx context.Context) error {
+	m.lock.Lock()
+	ordered, err := startOrder(m.components)
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, component := range ordered {
+		fmt.Printf("Starting %s\n", component.Name)
+		if err := run(ctx, component, component.Start, "start"); err != nil {
+			logger.ErrorLog(err)
+			if stopErr := m.Stop(context.Background()); stopErr != nil {
+				logger.ErrorLog(stopErr)
+			}
+			return err
+		}
+		m.lock.Lock()
+		m.started = append(m.started, component)
+		m.lock.Unlock()
+	}
+	return nil
+}
+
+// Stop stops the started components in reverse order. A component that fails or
+// times out doesn't hold up the others, every failure is logged and reported in
+// the returned error.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.lock.Lock()
+	started := m.started
+	m.started = nil
+	m.lock.Unlock()
+
+	failures := []string{}
+	for i := len(started) - 1; i >= 0; i-- {
+		component := started[i]
+		fmt.Printf("Stopping %s\n", component.Name)
+		if err := run(ctx, component, component.Stop, "stop"); err != nil {
+			logger.ErrorLog(err)
+			failures = append(failures, errorMessage(err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Newf("Failed to stop %d components: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// run calls a start or stop hook, giving up on it after the component timeout.
+func run(ctx context.Context, component *Component, hook func(ctx context.Context) error, action string) error {
+	if hook == nil {
+		return nil
+	}
+	timeout := component.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result <- errors.Newf("panicked: %v", r)
+			}
+		}()
+		result <- hook(ctx)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Couldn't %s %s: %s", action, component.Name, errorMessage(err)))
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.Newf("Couldn't %s %s: timed out after %s", action, component.Name, timeout)
+	}
+}
+
+// startOrder sorts the components so each comes after its dependencies, keeping the
+// registration order otherwise.
+func startOrder(components []*Component) ([]*Component, error) {
+	byName := map[string]*Component{}
+	for _, component := range components {
+		byName[component.Name] = component
+	}
+	for _, component := range components {
+		for _, dependency := range component.DependsOn {
+			if _, ok := byName[dependency]; !ok {
+				return nil, errors.Newf("Component %s depends on unknown component %s", component.Name, dependency)
+			}
+		}
+	}
+
+	ordered := []*Component{}
+	done := map[string]bool{}
+	visiting := map[string]bool{}
+	var visit func(component *Component) error
+	visit = func(component *Component) error {
+		if done[component.Name] {
+			return nil
+		}
+		if visiting[component.Name] {
+			return errors.Newf("Components depend on each other through %s", component.Name)
+		}
+		visiting[component.Name] = true
+		for _, dependency := range component.DependsOn {
+			if err := visit(byName[dependency]); err != nil {
+				return err
+			}
+		}
+		visiting[component.Name] = false
+		done[component.Name] = true
+		ordered = append(ordered, component)
+		return nil
+	}
+	for _, component := range components {
+		if err := visit(component); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+func errorMessage(err error) string {
+	if fiverrErr, ok := err.(errors.FiverrError); ok {
+		return fiverrErr.GetMessage()
+	}
+	return err.Error()
+}
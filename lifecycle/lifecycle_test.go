@@ -0,0 +1,120 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func recorder(calls *[]string, name string, deps ...string) Component {
+	return Component{
+		Name:      name,
+		DependsOn: deps,
+		Start: func(ctx context.Context) error {
+			*calls = append(*calls, "start "+name)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			*calls = append(*calls, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestStartsInDependencyOrderAndStopsInReverse(t *testing.T) {
+	calls := []string{}
+	m := New()
+	m.Register(recorder(&calls, "worker", "connectors"))
+	m.Register(recorder(&calls, "connectors", "logger"))
+	m.Register(recorder(&calls, "logger"))
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"start logger", "start connectors", "start worker",
+		"stop worker", "stop connectors", "stop logger",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected %v but got %v", expected, calls)
+	}
+}
+
+func TestFailedStartStopsStartedComponents(t *testing.T) {
+	calls := []string{}
+	m := New()
+	m.Register(recorder(&calls, "logger"))
+	broken := recorder(&calls, "connectors", "logger")
+	broken.Start = func(ctx context.Context) error { return errors.New("no database") }
+	m.Register(broken)
+	m.Register(recorder(&calls, "worker", "connectors"))
+
+	err := m.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no database") {
+		t.Fatalf("Expected the start error, got %v", err)
+	}
+	expected := []string{"start logger", "stop logger"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected %v but got %v", expected, calls)
+	}
+}
+
+func TestStopReportsFailuresAndTimeouts(t *testing.T) {
+	calls := []string{}
+	m := New()
+	m.Register(recorder(&calls, "logger"))
+	m.Register(Component{
+		Name:      "connectors",
+		DependsOn: []string{"logger"},
+		Stop:      func(ctx context.Context) error { return errors.New("rabbit: already closed") },
+	})
+	m.Register(Component{
+		Name:      "worker",
+		DependsOn: []string{"connectors"},
+		Timeout:   10 * time.Millisecond,
+		Stop: func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(time.Second)
+			return nil
+		},
+	})
+	m.Start(context.Background())
+
+	err := m.Stop(context.Background())
+	if err == nil {
+		t.Fatal("Expected the stop failures to be reported")
+	}
+	for _, part := range []string{"Failed to stop 2 components", "stop worker: timed out", "stop connectors"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("Expected %q in %s", part, err)
+		}
+	}
+	if calls[len(calls)-1] != "stop logger" {
+		t.Errorf("Expected the logger to be stopped anyway, got %v", calls)
+	}
+}
+
+func TestStartOrderErrors(t *testing.T) {
+	m := New()
+	m.Register(Component{Name: "worker", DependsOn: []string{"connectors"}})
+	if err := m.Start(context.Background()); err == nil {
+		t.Errorf("Expected an unknown dependency to fail")
+	}
+
+	m = New()
+	m.Register(Component{Name: "a", DependsOn: []string{"b"}})
+	m.Register(Component{Name: "b", DependsOn: []string{"a"}})
+	if err := m.Start(context.Background()); err == nil {
+		t.Errorf("Expected a dependency cycle to fail")
+	}
+
+	if err := m.Register(Component{Name: "a"}); err == nil {
+		t.Errorf("Expected a duplicate name to fail")
+	}
+}
@@ -33,6 +33,11 @@ func InitLogger(host string, port int) {
 	})
 }
 
+// WarningLog logs something worth looking into that didn't fail, e.g. a slow query.
+func WarningLog(err error) {
+	Log(err, 2)
+}
+
 func ErrorLog(err error) {
 	Log(err, 3)
 }
@@ -56,6 +61,10 @@ func Log(err error, level int) {
 
 	log.Println(logMessage)
 	fmt.Println(logMessage)
+	// Graylog is not initialized when running locally, e.g. replaying events
+	if Graylog == nil {
+		return
+	}
 	jsonByteMessage, _ := json.Marshal(logMessage)
 	jsonMessage := string(jsonByteMessage)
 	Graylog.Log(jsonMessage)
@@ -0,0 +1,188 @@
+package publisher
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/tracing"
+)
+
+// OutboxTable is the MySQL table holding events waiting to be published.
+var OutboxTable = "event_outbox"
+
+// EnsureOutboxTable creates the outbox table if it doesn't exist yet.
+func EnsureOutboxTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		exchange VARCHAR(255) NOT NULL,
+		routing_key VARCHAR(255) NOT NULL,
+		payload MEDIUMBLOB NOT NULL,
+		headers TEXT NULL,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME NULL,
+		KEY pending (sent_at, id)
+	) ENGINE=InnoDB`, OutboxTable))
+	if err != nil {
+		return errors.Wrap(err, "Couldn't create outbox table")
+	}
+	return nil
+}
+
+// WriteOutbox stores an event in the outbox as part of the caller's transaction, so it
+// is only published if the transaction commits. The transaction usually comes from
+// connectors.Clients.MySql(). RelayOutbox then publishes it.
+func WriteOutbox(tx *sql.Tx, exchange, routingKey string, params map[string]interface{}) error {
+	return WriteOutboxContext(context.Background(), tx, exchange, routingKey, params)
+}
+
+// WriteOutboxContext is like WriteOutbox but stores the trace context of ctx with the
+// event, so the relay publishes it as part of the same trace.
+func WriteOutboxContext(ctx context.Context, tx *sql.Tx, exchange, routingKey string, params map[string]interface{}) error {
+	// sensitive events are encrypted before they even reach the outbox table
+	payload, err := encodeEvent(params)
+	if err != nil {
+		return err
+	}
+	headers, err := encodeTraceHeaders(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		fmt.Sprintf("INSERT INTO %s (exchange, routing_key, payload, headers, created_at) VALUES (?, ?, ?, ?, ?)", OutboxTable),
+		exchange, routingKey, payload, headers, time.Now().UTC())
+	if err != nil {
+		return errors.Wrap(err, "Couldn't write event to outbox")
+	}
+	return nil
+}
+
+// RelayOutbox publishes pending outbox rows every interval, in insertion order, until
+// stop is closed. Rows are locked with SELECT ... FOR UPDATE while being published, so
+// a second relay, e.g. on another instance, waits for the first one's batch instead of
+// publishing it again. Relays therefore take turns rather than sharing the load, which
+// is what keeps events in order. Delivery is at least once: a crash between the broker
+// confirming an event and marking the row sent publishes it again. Stopping doesn't
+// wait for a backlog to be relayed, the batch being published is finished first.
+func RelayOutbox(db *sql.DB, batchSize int, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// keep going while there is a backlog.
+		for {
+			sent, err := relayOutboxBatch(db, batchSize)
+			if err != nil {
+				logger.ErrorLog(errors.Wrap(err, err.Error()))
+			}
+			if err != nil || sent < batchSize {
+				break
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// encodeTraceHeaders returns the traceparent headers of ctx as JSON, or nil when ctx
+// isn't traced.
+func encodeTraceHeaders(ctx context.Context) (interface{}, error) {
+	headers := amqp.Table{}
+	tracing.Inject(ctx, headers)
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't marshal trace headers")
+	}
+	return string(encoded), nil
+}
+
+// traceContext continues the trace stored with an outbox row, if any.
+func traceContext(stored sql.NullString) context.Context {
+	ctx := context.Background()
+	if !stored.Valid {
+		return ctx
+	}
+	headers := amqp.Table{}
+	if err := json.Unmarshal([]byte(stored.String), &headers); err != nil {
+		logger.ErrorLog(errors.Wrap(err, "Couldn't read outbox trace headers"))
+		return ctx
+	}
+	return tracing.Extract(ctx, headers)
+}
+
+// relayPublish publishes an outbox row, tests replace it.
+var relayPublish = publishBody
+
+type outboxRow struct {
+	id         int64
+	exchange   string
+	routingKey string
+	payload    []byte
+	headers    sql.NullString
+}
+
+// relayOutboxBatch publishes up to batchSize pending rows and returns how many were sent.
+// It stops at the first failure so events are never published out of order.
+func relayOutboxBatch(db *sql.DB, batchSize int) (sent int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "Couldn't start outbox transaction")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			sent, err = 0, errors.Wrap(commitErr, "Couldn't commit outbox transaction")
+		}
+	}()
+
+	rows, err := tx.Query(fmt.Sprintf(
+		"SELECT id, exchange, routing_key, payload, headers FROM %s WHERE sent_at IS NULL ORDER BY id LIMIT ? FOR UPDATE",
+		OutboxTable), batchSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "Couldn't read outbox")
+	}
+	pending := []outboxRow{}
+	for rows.Next() {
+		var row outboxRow
+		if err = rows.Scan(&row.id, &row.exchange, &row.routingKey, &row.payload, &row.headers); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "Couldn't read outbox row")
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "Couldn't read outbox")
+	}
+
+	for _, row := range pending {
+		if publishErr := relayPublish(traceContext(row.headers), row.exchange, row.routingKey, row.payload); publishErr != nil {
+			// keep what was already sent, retry the rest next time.
+			logger.ErrorLog(errors.Wrapf(publishErr, "Couldn't relay outbox event %d", row.id))
+			return sent, nil
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET sent_at = ? WHERE id = ?", OutboxTable), time.Now().UTC(), row.id)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Couldn't mark outbox event %d as sent", row.id)
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,329 @@
+package publisher
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOutbox is an in memory outbox table behind a database/sql driver.
+type fakeOutbox struct {
+	lock      sync.Mutex
+	rows      []*fakeOutboxRow
+	commits   int
+	rollbacks int
+}
+
+type fakeOutboxRow struct {
+	id         int64
+	exchange   string
+	routingKey string
+	payload    []byte
+	headers    interface{}
+	sent       bool
+}
+
+func (outbox *fakeOutbox) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeOutboxConn{outbox}, nil
+}
+
+func (outbox *fakeOutbox) Driver() driver.Driver {
+	return nil
+}
+
+func (outbox *fakeOutbox) pending() []*fakeOutboxRow {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	pending := []*fakeOutboxRow{}
+	for _, row := range outbox.rows {
+		if !row.sent {
+			pending = append(pending, row)
+		}
+	}
+	return pending
+}
+
+type fakeOutboxConn struct {
+	outbox *fakeOutbox
+}
+
+func (conn *fakeOutboxConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (conn *fakeOutboxConn) Close() error {
+	return nil
+}
+
+func (conn *fakeOutboxConn) Begin() (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn *fakeOutboxConn) Commit() error {
+	conn.outbox.lock.Lock()
+	defer conn.outbox.lock.Unlock()
+	conn.outbox.commits++
+	return nil
+}
+
+func (conn *fakeOutboxConn) Rollback() error {
+	conn.outbox.lock.Lock()
+	defer conn.outbox.lock.Unlock()
+	conn.outbox.rollbacks++
+	return nil
+}
+
+func (conn *fakeOutboxConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	outbox := conn.outbox
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	switch {
+	case strings.HasPrefix(query, "INSERT"):
+		outbox.rows = append(outbox.rows, &fakeOutboxRow{
+			id:         int64(len(outbox.rows) + 1),
+			exchange:   args[0].Value.(string),
+			routingKey: args[1].Value.(string),
+			payload:    args[2].Value.([]byte),
+			headers:    args[3].Value,
+		})
+	case strings.HasPrefix(query, "UPDATE"):
+		outbox.rows[args[1].Value.(int64)-1].sent = true
+	default:
+		return nil, errors.New("unexpected statement " + query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (conn *fakeOutboxConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, "SELECT") {
+		return nil, errors.New("unexpected query " + query)
+	}
+	pending := conn.outbox.pending()
+	if limit := int(args[0].Value.(int64)); len(pending) > limit {
+		pending = pending[:limit]
+	}
+	return &fakeOutboxRows{rows: pending}, nil
+}
+
+type fakeOutboxRows struct {
+	rows []*fakeOutboxRow
+}
+
+func (rows *fakeOutboxRows) Columns() []string {
+	return []string{"id", "exchange", "routing_key", "payload", "headers"}
+}
+
+func (rows *fakeOutboxRows) Close() error {
+	return nil
+}
+
+func (rows *fakeOutboxRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	row := rows.rows[0]
+	rows.rows = rows.rows[1:]
+	dest[0], dest[1], dest[2], dest[3], dest[4] = row.id, row.exchange, row.routingKey, row.payload, row.headers
+	return nil
+}
+
+type published struct {
+	ctx        context.Context
+	exchange   string
+	routingKey string
+	event      map[string]interface{}
+}
+
+// stubRelay replaces relayPublish, failing the events named in fail.
+func stubRelay(t *testing.T, fail map[string]bool) *[]published {
+	sent := &[]published{}
+	original := relayPublish
+	t.Cleanup(func() { relayPublish = original })
+	relayPublish = func(ctx context.Context, exchange, routingKey string, body []byte) error {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatalf("Relayed an invalid payload %s", body)
+		}
+		if fail[event["event"].(string)] {
+			return errors.New("broker is down")
+		}
+		*sent = append(*sent, published{ctx, exchange, routingKey, event})
+		return nil
+	}
+	return sent
+}
+
+func writeEvents(t *testing.T, db *sql.DB, names ...string) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := WriteOutbox(tx, "events", "orders."+name, map[string]interface{}{"event": name}); err != nil {
+			t.Fatalf("Couldn't write %s: %v", name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventNames(sent []published) []string {
+	names := []string{}
+	for _, event := range sent {
+		names = append(names, event.event["event"].(string))
+	}
+	return names
+}
+
+func TestRelayOutboxBatch(t *testing.T) {
+	outbox := &fakeOutbox{}
+	db := sql.OpenDB(outbox)
+	defer db.Close()
+	sent := stubRelay(t, nil)
+	writeEvents(t, db, "created", "paid", "shipped")
+
+	if n, err := relayOutboxBatch(db, 2); n != 2 || err != nil {
+		t.Fatalf("Expected a full batch of 2 got %d, %v", n, err)
+	}
+	if n, err := relayOutboxBatch(db, 2); n != 1 || err != nil {
+		t.Fatalf("Expected the last event got %d, %v", n, err)
+	}
+	if n, err := relayOutboxBatch(db, 2); n != 0 || err != nil {
+		t.Fatalf("Expected nothing left got %d, %v", n, err)
+	}
+	if names := strings.Join(eventNames(*sent), ","); names != "created,paid,shipped" {
+		t.Errorf("Expected events in insertion order got %s", names)
+	}
+	if (*sent)[0].exchange != "events" || (*sent)[0].routingKey != "orders.created" {
+		t.Errorf("Expected the stored exchange and routing key got %+v", (*sent)[0])
+	}
+	if len(outbox.pending()) != 0 {
+		t.Errorf("Expected every row marked sent got %d pending", len(outbox.pending()))
+	}
+}
+
+func TestRelayOutboxBatchStopsAtFailure(t *testing.T) {
+	outbox := &fakeOutbox{}
+	db := sql.OpenDB(outbox)
+	defer db.Close()
+	sent := stubRelay(t, map[string]bool{"paid": true})
+	writeEvents(t, db, "created", "paid", "shipped")
+
+	if n, err := relayOutboxBatch(db, 10); n != 1 || err != nil {
+		t.Fatalf("Expected to stop after the first event got %d, %v", n, err)
+	}
+	if names := strings.Join(eventNames(*sent), ","); names != "created" {
+		t.Errorf("Expected nothing published past the failure got %s", names)
+	}
+	if pending := outbox.pending(); len(pending) != 2 || pending[0].id != 2 {
+		t.Errorf("Expected the failed event and the ones after it to stay pending got %d", len(pending))
+	}
+	if outbox.commits < 2 {
+		t.Errorf("Expected the rows sent before the failure to be committed")
+	}
+
+	sent = stubRelay(t, nil)
+	if n, err := relayOutboxBatch(db, 10); n != 2 || err != nil {
+		t.Fatalf("Expected the retry to send the rest got %d, %v", n, err)
+	}
+	if names := strings.Join(eventNames(*sent), ","); names != "paid,shipped" {
+		t.Errorf("Expected the rest in order got %s", names)
+	}
+}
+
+func TestRelayOutboxContinuesTrace(t *testing.T) {
+	outbox := &fakeOutbox{}
+	db := sql.OpenDB(outbox)
+	defer db.Close()
+	sent := stubRelay(t, nil)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+	tx, _ := db.Begin()
+	if err := WriteOutboxContext(ctx, tx, "events", "orders.created", map[string]interface{}{"event": "created"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOutbox(tx, "events", "orders.paid", map[string]interface{}{"event": "paid"}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if outbox.rows[1].headers != nil {
+		t.Errorf("Expected no headers stored without a trace got %v", outbox.rows[1].headers)
+	}
+
+	if n, err := relayOutboxBatch(db, 10); n != 2 || err != nil {
+		t.Fatalf("Expected both events relayed got %d, %v", n, err)
+	}
+	if relayed := trace.SpanContextFromContext((*sent)[0].ctx).TraceID(); relayed != traceID {
+		t.Errorf("Expected the relay to continue trace %s got %s", traceID, relayed)
+	}
+	if trace.SpanContextFromContext((*sent)[1].ctx).IsValid() {
+		t.Error("Expected the untraced event to be relayed without a trace")
+	}
+}
+
+func TestRelayOutboxDrainsBacklog(t *testing.T) {
+	outbox := &fakeOutbox{}
+	db := sql.OpenDB(outbox)
+	defer db.Close()
+	sent := stubRelay(t, nil)
+	writeEvents(t, db, "created", "paid", "shipped")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		RelayOutbox(db, 1, time.Hour, stop)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(outbox.pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	if names := strings.Join(eventNames(*sent), ","); names != "created,paid,shipped" {
+		t.Errorf("Expected the whole backlog without waiting for the interval got %s", names)
+	}
+}
+
+func TestRelayOutboxStopsBetweenBatches(t *testing.T) {
+	outbox := &fakeOutbox{}
+	db := sql.OpenDB(outbox)
+	defer db.Close()
+	sent := stubRelay(t, nil)
+	writeEvents(t, db, "created", "paid", "shipped")
+
+	stop := make(chan struct{})
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		RelayOutbox(db, 1, time.Hour, stop)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the relay to stop without relaying the whole backlog")
+	}
+	if names := strings.Join(eventNames(*sent), ","); names != "created" {
+		t.Errorf("Expected only the batch in progress to be relayed got %s", names)
+	}
+	if len(outbox.pending()) != 2 {
+		t.Errorf("Expected the rest of the backlog to stay pending got %d", len(outbox.pending()))
+	}
+}
@@ -0,0 +1,153 @@
+// Package publisher publishes events to RabbitMQ, optionally through a MySQL outbox.
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/encryption"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/tracing"
+)
+
+var (
+	// ConfirmTimeout is how long Publish waits for the broker to confirm a message.
+	ConfirmTimeout = 5 * time.Second
+
+	lock          sync.Mutex
+	channel       *amqp.Channel
+	confirmations chan amqp.Confirmation
+
+	encryptionLock  sync.RWMutex
+	keyring         *encryption.Keyring
+	encryptedEvents = map[string]bool{}
+)
+
+// EncryptEvents makes Publish and WriteOutbox encrypt the params of the named events
+// with keyring. Consumers need the same keys, see worker.SetKeyring.
+func EncryptEvents(k *encryption.Keyring, eventNames ...string) {
+	encryptionLock.Lock()
+	defer encryptionLock.Unlock()
+	keyring = k
+	for _, name := range eventNames {
+		encryptedEvents[name] = true
+	}
+}
+
+// encodeEvent marshals params, encrypting them first if their event is sensitive.
+func encodeEvent(params map[string]interface{}) ([]byte, error) {
+	eventName, _ := params["event"].(string)
+	encryptionLock.RLock()
+	k, encrypt := keyring, encryptedEvents[eventName]
+	encryptionLock.RUnlock()
+
+	if encrypt && k != nil {
+		sealed, err := k.Seal(eventName, params)
+		if err != nil {
+			return nil, err
+		}
+		params = sealed
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't marshal event")
+	}
+	return body, nil
+}
+
+// Publish sends params as a JSON event to exchange with routingKey and waits for the
+// broker to confirm it. The event name is expected under the "event" key, which is
+// where the worker looks for it.
+func Publish(exchange, routingKey string, params map[string]interface{}) error {
+	return PublishContext(context.Background(), exchange, routingKey, params)
+}
+
+// PublishContext is like Publish but continues the trace in ctx, e.g. the one
+// started by the tracing middleware, so the consuming task joins it.
+func PublishContext(ctx context.Context, exchange, routingKey string, params map[string]interface{}) error {
+	body, err := encodeEvent(params)
+	if err != nil {
+		return err
+	}
+	return publishBody(ctx, exchange, routingKey, body)
+}
+
+// publishBody publishes an already encoded event on the shared confirm channel.
+func publishBody(ctx context.Context, exchange, routingKey string, body []byte) (err error) {
+	headers := amqp.Table{}
+	_, span := tracing.StartPublishSpan(ctx, exchange, routingKey, headers)
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
+	return publishConfirmed(exchange, routingKey, headers, body)
+}
+
+// publishConfirmed publishes and waits for the broker confirmation. Publishes are
+// serialized so every confirmation matches the message we just sent.
+func publishConfirmed(exchange, routingKey string, headers amqp.Table, body []byte) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if channel == nil {
+		if err := openConfirmChannel(); err != nil {
+			return err
+		}
+	}
+
+	err := channel.Publish(exchange, routingKey, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     "application/json",
+		ContentEncoding: "UTF-8",
+		Body:            body,
+		DeliveryMode:    amqp.Persistent,
+		Timestamp:       time.Now(),
+	})
+	if err != nil {
+		resetChannel()
+		return errors.Wrap(err, "Couldn't publish event")
+	}
+
+	select {
+	case confirm, ok := <-confirmations:
+		if !ok {
+			resetChannel()
+			return errors.New("Channel closed before the event was confirmed")
+		}
+		if !confirm.Ack {
+			return errors.Newf("Broker rejected event for %s", routingKey)
+		}
+		return nil
+	case <-time.After(ConfirmTimeout):
+		// a late confirmation would be matched to the next message, start over.
+		resetChannel()
+		return errors.Newf("Timed out waiting for confirmation of event for %s", routingKey)
+	}
+}
+
+func openConfirmChannel() error {
+	ch, err := connectors.Clients.NewRabbitChannel()
+	if err != nil {
+		return err
+	}
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return errors.Wrap(err, "Couldn't put channel in confirm mode")
+	}
+	channel = ch
+	confirmations = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+func resetChannel() {
+	if channel != nil {
+		channel.Close()
+	}
+	channel = nil
+	confirmations = nil
+}
@@ -0,0 +1,386 @@
+// Package saga runs multi-step workflows on top of worker tasks. Each step is
+// triggered by an event of its own, e.g. order_charge, order_deliver and order_notify,
+// and the events of a run are tied together by the IDParam they carry. The run state
+// is persisted between events, so it can be queried by ID, and a redelivered event
+// doesn't run its step again. Every step may have a compensating step, which is run,
+// in reverse order, for all completed steps when a later step fails.
+package saga
+
+import (
+	"fmt"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/worker"
+)
+
+// IDParam is the event param holding the workflow ID, every event of a workflow must
+// have it. The first event starts the run with that ID, the next ones move it on. Use
+// an ID of the business entity, e.g. the order ID, so the events of the run can be
+// published by whoever knows about it.
+const IDParam = "workflow_id"
+
+// Status of a workflow.
+type Status string
+
+const (
+	// Running means the run is waiting for the event of its next step.
+	Running      Status = "running"
+	Completed    Status = "completed"
+	Compensating Status = "compensating"
+	// Compensated means a step failed and every completed step was compensated.
+	Compensated Status = "compensated"
+	// Failed means a step failed and some compensations failed too, it needs a human.
+	Failed Status = "failed"
+)
+
+// Step is a single step of a workflow. Compensate may be nil for steps with nothing to undo.
+// Steps may add params to the event for the steps after them, they are persisted too.
+type Step struct {
+	Name string
+	// Event is the name of the event that runs the step, it defaults to Name.
+	Event      string
+	Action     worker.WorkerTask
+	Compensate worker.WorkerTask
+}
+
+// Workflow is an ordered list of steps, each run by its own event. The steps run in
+// order: an event whose step comes after one that didn't run yet fails. An event that
+// arrives while another step of its run is running, e.g. the one that published it,
+// waits for it for up to WaitTimeout. Steps should publish the events after them
+// rather than call Run themselves, it would wait for the step calling it.
+type Workflow struct {
+	Name  string
+	Steps []Step
+}
+
+// State is the persisted state of a single workflow run.
+type State struct {
+	ID                 string                 `bson:"_id" json:"id"`
+	Workflow           string                 `bson:"workflow" json:"workflow"`
+	Status             Status                 `bson:"status" json:"status"`
+	Params             map[string]interface{} `bson:"params" json:"params"`
+	CompletedSteps     []string               `bson:"completed_steps" json:"completed_steps"`
+	FailedStep         string                 `bson:"failed_step,omitempty" json:"failed_step,omitempty"`
+	Error              string                 `bson:"error,omitempty" json:"error,omitempty"`
+	CompensationErrors []string               `bson:"compensation_errors,omitempty" json:"compensation_errors,omitempty"`
+	CreatedAt          time.Time              `bson:"created_at" json:"created_at"`
+	UpdatedAt          time.Time              `bson:"updated_at" json:"updated_at"`
+	// CompensatedSteps are the steps whose compensation ran, failed ones are in
+	// CompensationErrors too. They aren't run again when compensation is resumed.
+	CompensatedSteps []string `bson:"compensated_steps,omitempty" json:"compensated_steps,omitempty"`
+	// RunningStep is the step being run or compensated since ClaimedAt. No other event
+	// of the run does anything meanwhile, unless the claim is older than StepTimeout.
+	RunningStep string    `bson:"running_step,omitempty" json:"running_step,omitempty"`
+	ClaimedAt   time.Time `bson:"claimed_at,omitempty" json:"claimed_at,omitempty"`
+	// Version is incremented on every save, see Store.
+	Version int `bson:"version" json:"version"`
+}
+
+// Store persists workflow states.
+type Store interface {
+	// Save stores state only if the stored state is still at state.Version-1, version 1
+	// creating it. It returns ErrConflict if the run was saved by someone else meanwhile.
+	Save(state *State) error
+	// Load returns nil, nil when there is no workflow with that ID.
+	Load(id string) (*State, error)
+}
+
+// ErrConflict is returned by Store.Save when the state changed since it was loaded.
+var ErrConflict = errors.New("Workflow was saved by someone else")
+
+var store Store = &MongoStore{Connection: "default", Collection: "workflows"}
+
+var (
+	// StepTimeout is how long a step may run before another event of its run may take
+	// over, e.g. after the worker running it crashed.
+	StepTimeout = 10 * time.Minute
+	// WaitTimeout is how long an event waits for the step running on its run.
+	WaitTimeout = 30 * time.Second
+	// pollInterval is how often a waiting event loads the run again.
+	pollInterval = 50 * time.Millisecond
+)
+
+// SetStore changes where workflow states are persisted. Defaults to the "workflows"
+// collection of the default Mongo connection.
+func SetStore(s Store) {
+	store = s
+}
+
+// Register adds a worker task for the event of every step, running the step for its run.
+// It returns false if a step event is used twice or already has a task.
+func Register(workflow *Workflow) bool {
+	events := map[string]bool{}
+	for _, step := range workflow.Steps {
+		if events[step.event()] {
+			return false
+		}
+		events[step.event()] = true
+	}
+	for i, step := range workflow.Steps {
+		if !worker.Tasks.AddTask(step.event(), func(event *worker.Event) error {
+			_, err := Run(workflow, event)
+			return err
+		}) {
+			for _, added := range workflow.Steps[:i] {
+				worker.Tasks.RemoveTask(added.event())
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the state of a workflow run.
+func Get(id string) (*State, error) {
+	state, err := store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.Newf("Couldn't find workflow %s", id)
+	}
+	return state, nil
+}
+
+// Run runs the step of workflow triggered by event for the run of its IDParam. The
+// event of the first step starts the run. Events of steps that already ran are
+// redeliveries and do nothing, unless the run failed, then they fail too. A run that
+// stopped while compensating resumes its compensation. It returns an error if the
+// step failed, after compensating.
+func Run(workflow *Workflow, event *worker.Event) (*State, error) {
+	index := workflow.stepOf(event.Name)
+	if index < 0 {
+		return nil, errors.Newf("Workflow %s has no step for event %s", workflow.Name, event.Name)
+	}
+	step := workflow.Steps[index]
+	eventParams := event.Params
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		state, err := loadOrCreate(workflow, index, event)
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		event.Params = mergeParams(state.Params, eventParams)
+
+		if state.Status == Failed {
+			return state, errors.Newf("Workflow %s %s failed on step %s and needs a human, not running %s", workflow.Name, state.ID, state.FailedStep, step.Name)
+		}
+		if state.claimed() {
+			if time.Now().After(deadline) {
+				return state, errors.Newf("Workflow %s %s is still running step %s, not running %s", workflow.Name, state.ID, state.RunningStep, step.Name)
+			}
+			time.Sleep(pollInterval)
+			continue
+		}
+		if state.Status == Compensating {
+			if err := claim(state, state.FailedStep); err == ErrConflict {
+				continue
+			} else if err != nil {
+				return state, err
+			}
+			return state, finishCompensation(workflow, state, event, errors.New(state.Error))
+		}
+		if state.completed(step.Name) {
+			// this is a redelivery
+			return state, nil
+		}
+		if state.Status != Running {
+			return state, errors.Newf("Workflow %s %s is %s, not running %s", workflow.Name, state.ID, state.Status, step.Name)
+		}
+		if index > 0 && !state.completed(workflow.Steps[index-1].Name) {
+			return state, errors.Newf("Workflow %s %s got %s before step %s ran", workflow.Name, state.ID, event.Name, workflow.Steps[index-1].Name)
+		}
+		// on a conflict a concurrent delivery of this or another event got the run first
+		if err := claim(state, step.Name); err == ErrConflict {
+			continue
+		} else if err != nil {
+			return state, err
+		}
+		return state, runClaimedStep(workflow, state, index, event)
+	}
+}
+
+// runClaimedStep runs the step of a run claimed by claim and releases it.
+func runClaimedStep(workflow *Workflow, state *State, index int, event *worker.Event) error {
+	step := workflow.Steps[index]
+	if err := runStep(step.Action, event); err != nil {
+		return compensate(workflow, state, event, step.Name, err)
+	}
+	state.CompletedSteps = append(state.CompletedSteps, step.Name)
+	state.Params = event.Params
+	if index == len(workflow.Steps)-1 {
+		state.Status = Completed
+	}
+	release(state)
+	if err := save(state); err != nil {
+		return errors.Wrapf(err, "Couldn't complete step %s of workflow %s %s", step.Name, workflow.Name, state.ID)
+	}
+	return nil
+}
+
+func (workflow *Workflow) stepOf(eventName string) int {
+	for i, step := range workflow.Steps {
+		if step.event() == eventName {
+			return i
+		}
+	}
+	return -1
+}
+
+func (step Step) event() string {
+	if step.Event == "" {
+		return step.Name
+	}
+	return step.Event
+}
+
+// claim marks stepName as running on the run, it fails if the run was saved meanwhile.
+func claim(state *State, stepName string) error {
+	state.RunningStep = stepName
+	state.ClaimedAt = time.Now()
+	return save(state)
+}
+
+func release(state *State) {
+	state.RunningStep = ""
+	state.ClaimedAt = time.Time{}
+}
+
+// claimed is true while another event is running a step of the run.
+func (state *State) claimed() bool {
+	return !state.ClaimedAt.IsZero() && time.Since(state.ClaimedAt) < StepTimeout
+}
+
+func (state *State) completed(stepName string) bool {
+	for _, name := range state.CompletedSteps {
+		if name == stepName {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOrCreate loads the run of the event, the event of the first step creates it.
+func loadOrCreate(workflow *Workflow, index int, event *worker.Event) (*State, error) {
+	id, err := event.GetString(IDParam)
+	if err != nil || id == "" {
+		return nil, errors.Newf("Event %s of workflow %s has no %s", event.Name, workflow.Name, IDParam)
+	}
+	state, err := store.Load(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't load workflow %s", id)
+	}
+	if state != nil {
+		if state.Workflow != workflow.Name {
+			return nil, errors.Newf("Workflow %s is a %s, not a %s", id, state.Workflow, workflow.Name)
+		}
+		return state, nil
+	}
+	if index > 0 {
+		return nil, errors.Newf("Workflow %s %s got %s before it started", workflow.Name, id, event.Name)
+	}
+
+	state = &State{
+		ID:             id,
+		Workflow:       workflow.Name,
+		Status:         Running,
+		Params:         map[string]interface{}{},
+		CompletedSteps: []string{},
+		CreatedAt:      time.Now(),
+	}
+	return state, save(state)
+}
+
+// mergeParams adds the params of an event to the ones of the run, the event wins.
+func mergeParams(stateParams map[string]interface{}, eventParams map[string]interface{}) map[string]interface{} {
+	params := map[string]interface{}{}
+	for k, v := range stateParams {
+		params[k] = v
+	}
+	for k, v := range eventParams {
+		params[k] = v
+	}
+	return params
+}
+
+// compensate undoes the completed steps in reverse order and records the outcome.
+func compensate(workflow *Workflow, state *State, event *worker.Event, failedStep string, stepErr error) error {
+	state.Status = Compensating
+	state.FailedStep = failedStep
+	state.Error = message(stepErr)
+	state.Params = event.Params
+	if err := save(state); err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+	}
+	return finishCompensation(workflow, state, event, stepErr)
+}
+
+// finishCompensation compensates the completed steps that weren't compensated yet,
+// saving after each one so a crash doesn't run a compensation twice.
+func finishCompensation(workflow *Workflow, state *State, event *worker.Event, stepErr error) error {
+	done := map[string]bool{}
+	for _, name := range state.CompletedSteps {
+		done[name] = true
+	}
+	for _, name := range state.CompensatedSteps {
+		done[name] = false
+	}
+	for i := len(workflow.Steps) - 1; i >= 0; i-- {
+		step := workflow.Steps[i]
+		if !done[step.Name] || step.Compensate == nil {
+			continue
+		}
+		state.RunningStep = step.Name
+		if err := runStep(step.Compensate, event); err != nil {
+			state.CompensationErrors = append(state.CompensationErrors, fmt.Sprintf("%s: %s", step.Name, message(err)))
+		}
+		state.CompensatedSteps = append(state.CompensatedSteps, step.Name)
+		if err := save(state); err != nil {
+			logger.ErrorLog(errors.Wrap(err, err.Error()))
+		}
+	}
+
+	state.Status = Compensated
+	if len(state.CompensationErrors) > 0 {
+		state.Status = Failed
+	}
+	release(state)
+	if err := save(state); err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+	}
+	return errors.Wrapf(stepErr, "Workflow %s %s failed on step %s", workflow.Name, state.ID, state.FailedStep)
+}
+
+// runStep runs a single action, turning a panic into an error so we still compensate.
+func runStep(task worker.WorkerTask, event *worker.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Newf("Step panicked: %v", r)
+		}
+	}()
+	return task(event)
+}
+
+func save(state *State) error {
+	state.UpdatedAt = time.Now()
+	state.Version++
+	if err := store.Save(state); err != nil {
+		state.Version--
+		if err == ErrConflict {
+			return err
+		}
+		return errors.Wrapf(err, "Couldn't save workflow %s", state.ID)
+	}
+	return nil
+}
+
+func message(err error) string {
+	if fiverrErr, ok := err.(errors.FiverrError); ok {
+		return fiverrErr.GetMessage()
+	}
+	return err.Error()
+}
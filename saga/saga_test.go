@@ -0,0 +1,359 @@
+package saga
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+	"testing"
+	"github.com/roeepolegfiverr/gofiverr/worker"
+)
+
+type memoryStore struct {
+	sync.Mutex
+	states map[string]State
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{states: map[string]State{}}
+}
+
+func (m *memoryStore) Save(state *State) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.states[state.ID].Version != state.Version-1 {
+		return ErrConflict
+	}
+	m.states[state.ID] = *state
+	return nil
+}
+
+func (m *memoryStore) Load(id string) (*State, error) {
+	m.Lock()
+	defer m.Unlock()
+	if state, ok := m.states[id]; ok {
+		return &state, nil
+	}
+	return nil, nil
+}
+
+func orderWorkflow(calls *[]string, failOn string) *Workflow {
+	step := func(name string) Step {
+		return Step{
+			Name:  name,
+			Event: "order_" + name,
+			Action: func(event *worker.Event) error {
+				*calls = append(*calls, name)
+				if name == failOn {
+					return errors.New(name + " is down")
+				}
+				event.Params[name+"_id"] = name + "-1"
+				return nil
+			},
+			Compensate: func(event *worker.Event) error {
+				*calls = append(*calls, "undo "+name)
+				return nil
+			},
+		}
+	}
+	return &Workflow{Name: "order", Steps: []Step{step("charge"), step("deliver"), step("notify")}}
+}
+
+func orderEvent(step string, id string) *worker.Event {
+	return &worker.Event{Name: "order_" + step, Params: map[string]interface{}{IDParam: id}}
+}
+
+func TestRunAcrossEvents(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "")
+
+	charge := orderEvent("charge", "order-7")
+	charge.Params["amount"] = 5.0
+	state, err := Run(workflow, charge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := Get("order-7"); saved.Status != Running || !reflect.DeepEqual(saved.CompletedSteps, []string{"charge"}) {
+		t.Errorf("Expected the run to wait for its next event got %+v", saved)
+	}
+
+	if _, err := Run(workflow, orderEvent("deliver", "order-7")); err != nil {
+		t.Fatal(err)
+	}
+	notify := orderEvent("notify", "order-7")
+	if state, err = Run(workflow, notify); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"charge", "deliver", "notify"}) {
+		t.Errorf("Unexpected calls %v", calls)
+	}
+	// later steps see the params of the events and steps before them
+	if notify.Params["amount"] != 5.0 || notify.Params["charge_id"] != "charge-1" {
+		t.Errorf("Expected the run params got %v", notify.Params)
+	}
+	saved, err := Get(state.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != Completed || saved.Params["deliver_id"] != "deliver-1" {
+		t.Errorf("Unexpected saved state %+v", saved)
+	}
+}
+
+func TestRunNeedsAnID(t *testing.T) {
+	memory := newMemoryStore()
+	SetStore(memory)
+	calls := []string{}
+	event := &worker.Event{Name: "order_charge", Params: map[string]interface{}{"order": 7.0}}
+	if _, err := Run(orderWorkflow(&calls, ""), event); err == nil {
+		t.Error("Expected an event without a workflow ID to fail")
+	}
+	if len(calls) != 0 || len(memory.states) != 0 {
+		t.Errorf("Expected nothing to run got %v", calls)
+	}
+}
+
+func TestRunsWithTheSameParamsAreApart(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "")
+	for _, id := range []string{"order-1", "order-2"} {
+		event := orderEvent("charge", id)
+		event.Params["amount"] = 5.0
+		if _, err := Run(workflow, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(calls, []string{"charge", "charge"}) {
+		t.Errorf("Expected both orders to be charged got %v", calls)
+	}
+}
+
+func TestRunStepsInOrder(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "")
+	if _, err := Run(workflow, orderEvent("deliver", "order-7")); err == nil {
+		t.Error("Expected a step of a run that didn't start to fail")
+	}
+	Run(workflow, orderEvent("charge", "order-7"))
+	if _, err := Run(workflow, orderEvent("notify", "order-7")); err == nil {
+		t.Error("Expected notify before deliver to fail")
+	}
+	if !reflect.DeepEqual(calls, []string{"charge"}) {
+		t.Errorf("Expected only charge to run got %v", calls)
+	}
+}
+
+func TestRunCompensatesInReverse(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "notify")
+	Run(workflow, orderEvent("charge", "order-7"))
+	Run(workflow, orderEvent("deliver", "order-7"))
+	state, err := Run(workflow, orderEvent("notify", "order-7"))
+	if err == nil {
+		t.Fatal("Expected the workflow to fail")
+	}
+	expected := []string{"charge", "deliver", "notify", "undo deliver", "undo charge"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v got %v", expected, calls)
+	}
+	saved, _ := Get(state.ID)
+	if saved.Status != Compensated || saved.FailedStep != "notify" || saved.Error != "notify is down" {
+		t.Errorf("Unexpected saved state %+v", saved)
+	}
+}
+
+func TestRedeliveredEventsDontRunAgain(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "")
+	Run(workflow, orderEvent("charge", "order-7"))
+	if _, err := Run(workflow, orderEvent("charge", "order-7")); err != nil {
+		t.Errorf("Expected a redelivered event to be acked got %v", err)
+	}
+	Run(workflow, orderEvent("deliver", "order-7"))
+	Run(workflow, orderEvent("notify", "order-7"))
+	if _, err := Run(workflow, orderEvent("notify", "order-7")); err != nil {
+		t.Errorf("Expected a redelivery to a completed run to be acked got %v", err)
+	}
+	if !reflect.DeepEqual(calls, []string{"charge", "deliver", "notify"}) {
+		t.Errorf("Expected every step to run once got %v", calls)
+	}
+}
+
+func TestRedeliveryToAFailedRunFails(t *testing.T) {
+	memory := newMemoryStore()
+	SetStore(memory)
+	memory.states["order-7"] = State{
+		ID:                 "order-7",
+		Version:            1,
+		Workflow:           "order",
+		Status:             Failed,
+		CompletedSteps:     []string{"charge"},
+		CompensatedSteps:   []string{"charge"},
+		CompensationErrors: []string{"charge: refunds are down"},
+		FailedStep:         "deliver",
+		Error:              "deliver is down",
+	}
+	calls := []string{}
+	if _, err := Run(orderWorkflow(&calls, ""), orderEvent("charge", "order-7")); err == nil {
+		t.Error("Expected a redelivery to a failed run to fail")
+	}
+	if len(calls) != 0 {
+		t.Errorf("Expected no calls got %v", calls)
+	}
+}
+
+func TestRunResumesCompensation(t *testing.T) {
+	memory := newMemoryStore()
+	SetStore(memory)
+	memory.states["order-7"] = State{
+		ID:               "order-7",
+		Version:          1,
+		Workflow:         "order",
+		Status:           Compensating,
+		Params:           map[string]interface{}{IDParam: "order-7"},
+		CompletedSteps:   []string{"charge", "deliver"},
+		CompensatedSteps: []string{"deliver"},
+		FailedStep:       "notify",
+		Error:            "notify is down",
+	}
+	calls := []string{}
+	state, err := Run(orderWorkflow(&calls, ""), orderEvent("notify", "order-7"))
+	if err == nil {
+		t.Fatal("Expected the resumed workflow to still fail")
+	}
+	if !reflect.DeepEqual(calls, []string{"undo charge"}) {
+		t.Errorf("Expected only the remaining compensation got %v", calls)
+	}
+	if state.Status != Compensated || memory.states["order-7"].Status != Compensated {
+		t.Errorf("Expected the workflow to end compensated got %s", memory.states["order-7"].Status)
+	}
+}
+
+func TestRegisterAddsATaskPerStep(t *testing.T) {
+	workflow := orderWorkflow(&[]string{}, "")
+	if !Register(workflow) {
+		t.Fatal("Expected the workflow to be registered")
+	}
+	defer func() {
+		for _, step := range workflow.Steps {
+			worker.Tasks.RemoveTask(step.Event)
+		}
+	}()
+	for _, step := range workflow.Steps {
+		if _, ok := worker.Tasks.Tasks[step.Event]; !ok {
+			t.Errorf("Expected a task for %s", step.Event)
+		}
+	}
+	if Register(orderWorkflow(&[]string{}, "")) {
+		t.Error("Expected the same events not to be registered twice")
+	}
+}
+
+func TestNextEventWaitsForTheStepPublishingIt(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "")
+	delivered := make(chan error, 1)
+	charge := workflow.Steps[0].Action
+	workflow.Steps[0].Action = func(event *worker.Event) error {
+		// the deliver event is consumed before charge returns
+		go func() {
+			_, err := Run(workflow, orderEvent("deliver", "order-7"))
+			delivered <- err
+		}()
+		time.Sleep(3 * pollInterval)
+		return charge(event)
+	}
+
+	if _, err := Run(workflow, orderEvent("charge", "order-7")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Fatalf("Expected deliver to wait for charge got %v", err)
+		}
+	case <-time.After(WaitTimeout):
+		t.Fatal("Expected deliver to run")
+	}
+	saved, _ := Get("order-7")
+	if !reflect.DeepEqual(saved.CompletedSteps, []string{"charge", "deliver"}) || saved.RunningStep != "" {
+		t.Errorf("Unexpected saved state %+v", saved)
+	}
+}
+
+func TestConcurrentDeliveriesRunTheStepOnce(t *testing.T) {
+	SetStore(newMemoryStore())
+	calls := []string{}
+	workflow := orderWorkflow(&calls, "")
+	charge := workflow.Steps[0].Action
+	workflow.Steps[0].Action = func(event *worker.Event) error {
+		time.Sleep(2 * pollInterval)
+		return charge(event)
+	}
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := Run(workflow, orderEvent("charge", "order-7"))
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Expected both deliveries to be acked got %v", err)
+		}
+	}
+	if !reflect.DeepEqual(calls, []string{"charge"}) {
+		t.Errorf("Expected the order to be charged once got %v", calls)
+	}
+}
+
+func TestStaleClaimIsTakenOver(t *testing.T) {
+	memory := newMemoryStore()
+	SetStore(memory)
+	memory.states["order-7"] = State{
+		ID:             "order-7",
+		Version:        1,
+		Workflow:       "order",
+		Status:         Running,
+		CompletedSteps: []string{},
+		RunningStep:    "charge",
+		ClaimedAt:      time.Now().Add(-StepTimeout),
+	}
+	calls := []string{}
+	if _, err := Run(orderWorkflow(&calls, ""), orderEvent("charge", "order-7")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"charge"}) {
+		t.Errorf("Expected the step of a crashed worker to run again got %v", calls)
+	}
+}
+
+func TestWaitingForAClaimTimesOut(t *testing.T) {
+	defer func(previous time.Duration) { WaitTimeout = previous }(WaitTimeout)
+	WaitTimeout = 2 * pollInterval
+	memory := newMemoryStore()
+	SetStore(memory)
+	memory.states["order-7"] = State{
+		ID:             "order-7",
+		Version:        1,
+		Workflow:       "order",
+		Status:         Running,
+		CompletedSteps: []string{},
+		RunningStep:    "charge",
+		ClaimedAt:      time.Now(),
+	}
+	calls := []string{}
+	if _, err := Run(orderWorkflow(&calls, ""), orderEvent("charge", "order-7")); err == nil {
+		t.Error("Expected waiting for a running step to time out")
+	}
+	if len(calls) != 0 {
+		t.Errorf("Expected no calls got %v", calls)
+	}
+}
@@ -0,0 +1,135 @@
+package saga
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// MongoStore keeps workflow states in a Mongo collection.
+type MongoStore struct {
+	// Connection is the name of the Mongo connection in connectors.
+	Connection string
+	Collection string
+}
+
+func (mongoStore *MongoStore) Save(state *State) error {
+	session, err := connectors.Clients.NamedMongo(mongoStore.Connection)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	collection := session.DB("").C(mongoStore.Collection)
+	if state.Version == 1 {
+		err = collection.Insert(state)
+		if mgo.IsDup(err) {
+			return ErrConflict
+		}
+		return err
+	}
+	err = collection.Update(bson.M{"_id": state.ID, "version": state.Version - 1}, state)
+	if err == mgo.ErrNotFound {
+		return ErrConflict
+	}
+	return err
+}
+
+func (mongoStore *MongoStore) Load(id string) (*State, error) {
+	session, err := connectors.Clients.NamedMongo(mongoStore.Connection)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	state := &State{}
+	err = session.DB("").C(mongoStore.Collection).FindId(id).One(state)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// MySqlStore keeps workflow states as JSON in a MySQL table, see EnsureTable.
+type MySqlStore struct {
+	// Connection is the name of the MySql connection in connectors.
+	Connection string
+	Table      string
+}
+
+// EnsureTable creates the workflows table if it doesn't exist yet.
+func (mySqlStore *MySqlStore) EnsureTable() error {
+	db, err := connectors.Clients.NamedMySql(mySqlStore.Connection)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id VARCHAR(64) NOT NULL PRIMARY KEY,
+		workflow VARCHAR(255) NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		state MEDIUMTEXT NOT NULL,
+		version INT NOT NULL,
+		updated_at DATETIME NOT NULL
+	) ENGINE=InnoDB`, mySqlStore.Table))
+	if err != nil {
+		return errors.Wrap(err, "Couldn't create workflows table")
+	}
+	return nil
+}
+
+func (mySqlStore *MySqlStore) Save(state *State) error {
+	db, err := connectors.Clients.NamedMySql(mySqlStore.Connection)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	var result sql.Result
+	if state.Version == 1 {
+		result, err = db.Exec(fmt.Sprintf(
+			"INSERT IGNORE INTO %s (id, workflow, status, state, version, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			mySqlStore.Table), state.ID, state.Workflow, string(state.Status), data, state.Version, state.UpdatedAt.UTC())
+	} else {
+		result, err = db.Exec(fmt.Sprintf(
+			"UPDATE %s SET status = ?, state = ?, version = ?, updated_at = ? WHERE id = ? AND version = ?",
+			mySqlStore.Table), string(state.Status), data, state.Version, state.UpdatedAt.UTC(), state.ID, state.Version-1)
+	}
+	if err != nil {
+		return err
+	}
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (mySqlStore *MySqlStore) Load(id string) (*State, error) {
+	db, err := connectors.Clients.NamedMySql(mySqlStore.Connection)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = db.QueryRow(fmt.Sprintf("SELECT state FROM %s WHERE id = ?", mySqlStore.Table), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/peterbourgon/g2s"
 	"os"
+	"strconv"
 	"time"
 	"github.com/roeepolegfiverr/gofiverr/errors"
 	"github.com/roeepolegfiverr/gofiverr/logger"
@@ -57,6 +58,36 @@ func StatsDWrapper(eventName string, worker func() error) func() error {
 	}
 }
 
+// Gauge reports the current value of something, such as a pool size, for this host.
+func Gauge(name string, value int) {
+	if stats == nil {
+		return
+	}
+	go stats.Client.Gauge(sampleRate, fmt.Sprintf("%s.%s", stats.Prefix, name), strconv.Itoa(value))
+}
+
+// Timing reports how long an operation took, for this host and for all of them.
+func Timing(name string, elapsed time.Duration) {
+	if stats == nil {
+		return
+	}
+	go func() {
+		stats.Client.Timing(sampleRate, fmt.Sprintf("%s.%s", stats.Prefix, name), elapsed)
+		stats.Client.Timing(sampleRate, fmt.Sprintf("%s.%s", stats.GlobalPrefix, name), elapsed)
+	}()
+}
+
+// Increment counts an occurrence of something, such as an error, for this host and for all of them.
+func Increment(name string) {
+	if stats == nil {
+		return
+	}
+	go func() {
+		stats.Client.Counter(sampleRate, fmt.Sprintf("%s.%s", stats.Prefix, name), 1)
+		stats.Client.Counter(sampleRate, fmt.Sprintf("%s.%s", stats.GlobalPrefix, name), 1)
+	}()
+}
+
 func logWork(elapsed time.Duration, err error, eventName string) {
 	status := "success"
 	if err != nil {
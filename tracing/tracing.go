@@ -0,0 +1,161 @@
+// Package tracing follows requests from gin handlers through RabbitMQ into worker
+// tasks. Trace context travels as W3C traceparent headers and spans are exported
+// with OpenTelemetry.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+const instrumentationName = "github.com/roeepolegfiverr/gofiverr"
+
+var propagator = propagation.TraceContext{}
+
+// InitTracing exports the spans of serviceName to an OTLP/HTTP collector at endpoint
+// (host:port). The returned function flushes and stops the exporter on shutdown.
+func InitTracing(serviceName, endpoint string, insecure bool) (func(context.Context) error, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't create OTLP exporter")
+	}
+	return InitTracingWithExporter(serviceName, sdktrace.WithBatcher(exporter)), nil
+}
+
+// InitTracingWithExporter installs a tracer provider using a custom span processor,
+// e.g. sdktrace.WithSyncer(tracetest.NewInMemoryExporter()) in tests.
+func InitTracingWithExporter(serviceName string, processor sdktrace.TracerProviderOption) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware starts a span for every request, continuing the trace of an incoming
+// traceparent header. Handlers get the span through c.Request.Context().
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracer().Start(ctx, fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("url.path", c.Request.URL.Path),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("status code %d", status))
+		}
+		for _, err := range c.Errors {
+			span.RecordError(err.Err)
+		}
+	}
+}
+
+// StartPublishSpan starts a producer span for an event about to be published and
+// injects its trace context into headers.
+func StartPublishSpan(ctx context.Context, exchange, routingKey string, headers amqp.Table) (context.Context, trace.Span) {
+	ctx, span := tracer().Start(ctx, fmt.Sprintf("%s publish", routingKey),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", routingKey),
+		))
+	Inject(ctx, headers)
+	return ctx, span
+}
+
+// StartConsumeSpan starts a consumer span for an event, as a child of ctx.
+func StartConsumeSpan(ctx context.Context, queueName, eventName string) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return tracer().Start(ctx, fmt.Sprintf("%s process", eventName),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", queueName),
+			attribute.String("messaging.operation.type", "process"),
+		))
+}
+
+// EndSpan records err, if any, and ends span.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		message := err.Error()
+		if fiverrErr, ok := err.(errors.FiverrError); ok {
+			message = fiverrErr.GetMessage()
+		}
+		span.SetStatus(codes.Error, message)
+	}
+	span.End()
+}
+
+// Inject writes the trace context of ctx into AMQP headers.
+func Inject(ctx context.Context, headers amqp.Table) {
+	propagator.Inject(ctx, tableCarrier(headers))
+}
+
+// Extract returns ctx carrying the trace context found in AMQP headers, if any.
+func Extract(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return propagator.Extract(ctx, tableCarrier(headers))
+}
+
+// tableCarrier lets the propagator read and write AMQP headers.
+type tableCarrier amqp.Table
+
+func (carrier tableCarrier) Get(key string) string {
+	switch v := carrier[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func (carrier tableCarrier) Set(key, value string) {
+	carrier[key] = value
+}
+
+func (carrier tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/streadway/amqp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceFromHTTPThroughRabbit(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := InitTracingWithExporter("tracing-test", sdktrace.WithSyncer(exporter))
+	defer shutdown(context.Background())
+
+	// a handler publishing an event, as a gin service would.
+	headers := amqp.Table{}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.POST("/orders", func(c *gin.Context) {
+		_, span := StartPublishSpan(c.Request.Context(), "fiverr.topic", "fiverr.events.order", headers)
+		span.End()
+		c.Status(http.StatusCreated)
+	})
+	request := httptest.NewRequest("POST", "/orders", nil)
+	request.Header.Set("traceparent", incomingTraceparent)
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	if _, ok := headers["traceparent"]; !ok {
+		t.Fatalf("Expected traceparent to be injected into %v", headers)
+	}
+
+	// the worker picking it up on the other side.
+	ctx := Extract(context.Background(), headers)
+	_, span := StartConsumeSpan(ctx, "orders_queue", "order")
+	EndSpan(span, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans got %d", len(spans))
+	}
+	traceID := trace.SpanContextFromContext(ctx).TraceID().String()
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the incoming trace to be continued got %s", traceID)
+	}
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("Span %s is not part of trace %s", span.Name, traceID)
+		}
+	}
+}
+
+func TestExtractWithoutHeaders(t *testing.T) {
+	ctx := Extract(context.Background(), nil)
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Error("Expected no trace context")
+	}
+}
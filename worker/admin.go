@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AdminRouter returns a gin engine exposing the worker admin endpoints, ready to be
+// served on its own port.
+func AdminRouter() *gin.Engine {
+	router := gin.New()
+	RegisterAdminRoutes(router)
+	return router
+}
+
+// RegisterAdminRoutes adds the worker admin endpoints to an existing router or group:
+//
+//	GET  /status          - the whole worker status
+//	GET  /tasks           - registered tasks and their success/failure counts
+//	GET  /jobs            - jobs currently in flight and their age
+//	POST /pause           - stop pulling messages from the queue
+//	POST /resume          - start pulling messages again
+//	POST /pool/:size      - resize the minions pool
+//	GET  /failed          - top failures of the last hour, or of ?since=<duration>,
+//	                        at most ?limit=<n> of them
+func RegisterAdminRoutes(router gin.IRoutes) {
+	router.GET("/status", adminStatus)
+	router.GET("/tasks", adminTasks)
+	router.GET("/jobs", adminJobs)
+	router.POST("/pause", adminPause)
+	router.POST("/resume", adminResume)
+	router.POST("/pool/:size", adminResizePool)
+	router.GET("/failed", adminFailed)
+}
+
+func adminStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, CurrentStatus())
+}
+
+func adminTasks(c *gin.Context) {
+	status := CurrentStatus()
+	c.JSON(http.StatusOK, gin.H{
+		"tasks":      status.Tasks,
+		"task_stats": status.TaskStats,
+	})
+}
+
+func adminJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"in_flight": CurrentStatus().InFlight})
+}
+
+func adminPause(c *gin.Context) {
+	if err := Pause(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"paused": true})
+}
+
+func adminResume(c *gin.Context) {
+	Resume()
+	c.JSON(http.StatusOK, gin.H{"paused": false})
+}
+
+func adminResizePool(c *gin.Context) {
+	size, err := strconv.Atoi(c.Param("size"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pool size must be a number"})
+		return
+	}
+	if err := ResizePool(size); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pool_size": size})
+}
+
+func adminFailed(c *gin.Context) {
+	since := time.Hour
+	if value := c.Query("since"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a duration, e.g. 1h"})
+			return
+		}
+		since = parsed
+	}
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		limit = parsed
+	}
+	groups, err := FailedQueueSummary(time.Now().Add(-since), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"failures": groups})
+}
@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func adminRequest(method string, path string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	AdminRouter().ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+func TestAdminStatus(t *testing.T) {
+	Tasks.AddTask("admin_task", func(event *Event) error { return nil })
+	defer Tasks.RemoveTask("admin_task")
+
+	response := adminRequest("GET", "/status")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", response.Code)
+	}
+	var status Status
+	if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range status.Tasks {
+		found = found || name == "admin_task"
+	}
+	if !found {
+		t.Errorf("Expected the task in the status got %v", status.Tasks)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	defer Resume()
+	if response := adminRequest("POST", "/pause"); response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", response.Code)
+	}
+	if !state.isPaused() || !CurrentStatus().Paused {
+		t.Error("Expected the worker to be paused")
+	}
+	if response := adminRequest("POST", "/resume"); response.Code != http.StatusOK {
+		t.Fatalf("Expected 200 got %d", response.Code)
+	}
+	if state.isPaused() {
+		t.Error("Expected the worker to resume")
+	}
+}
+
+func TestAdminRejectsBadInput(t *testing.T) {
+	for _, path := range []string{"/pool/many", "/pool/0"} {
+		if response := adminRequest("POST", path); response.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s got %d", path, response.Code)
+		}
+	}
+	for _, path := range []string{"/failed?since=yesterday", "/failed?limit=ten", "/failed?limit=-1"} {
+		if response := adminRequest("GET", path); response.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s got %d", path, response.Code)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/statsd"
+)
+
+// AutoscaleConfig bounds and tunes the minions pool autoscaler.
+type AutoscaleConfig struct {
+	// MinWorkers and MaxWorkers bound the pool size.
+	MinWorkers int
+	MaxWorkers int
+	// MessagesPerWorker is the queue depth a single minion is expected to keep up with.
+	MessagesPerWorker int
+	// TargetLatency is the average task duration above which the pool grows while
+	// there is a backlog. Zero disables latency based scaling.
+	TargetLatency time.Duration
+	// PrefetchPerWorker is multiplied by the pool size to get the broker prefetch.
+	// Zero leaves the prefetch alone.
+	PrefetchPerWorker int
+	// Interval is how often the queue is inspected. Defaults to 10 seconds.
+	Interval time.Duration
+}
+
+var autoscaling *AutoscaleConfig
+
+// EnableAutoscaling makes Consume grow and shrink the minions pool between the
+// configured bounds instead of keeping workersInPool fixed. Call it before Consume.
+// Drain stops autoscaling, Resume starts it again.
+func EnableAutoscaling(cfg AutoscaleConfig) error {
+	if cfg.MinWorkers < 1 || cfg.MaxWorkers < cfg.MinWorkers {
+		return errors.Newf("Invalid autoscale bounds min %d max %d", cfg.MinWorkers, cfg.MaxWorkers)
+	}
+	if cfg.MessagesPerWorker < 1 {
+		return errors.Newf("MessagesPerWorker must be positive, got %d", cfg.MessagesPerWorker)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	autoscaling = &cfg
+	return nil
+}
+
+// autoscale resizes minions every cfg.Interval until stop is closed.
+func autoscale(queueName string, cfg AutoscaleConfig, minions *pool, stop <-chan struct{}) {
+	resize(cfg, minions, clampPoolSize(cfg, minions.size()))
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		depth, err := currentBroker().QueueDepth(queueName)
+		if err != nil {
+			logger.ErrorLog(errors.Wrap(err, "Couldn't inspect queue for autoscaling"))
+			continue
+		}
+		current := minions.size()
+		wanted := desiredPoolSize(cfg, depth, state.takeLatency(), current)
+		if wanted != current {
+			fmt.Printf("Autoscaling queue %s from %d to %d minions (%d messages waiting)\n", queueName, current, wanted, depth)
+		}
+		resize(cfg, minions, wanted)
+	}
+}
+
+func resize(cfg AutoscaleConfig, minions *pool, size int) {
+	minions.resize(size)
+	if cfg.PrefetchPerWorker > 0 {
+		if err := currentBroker().SetPrefetch(size * cfg.PrefetchPerWorker); err != nil {
+			logger.ErrorLog(errors.Wrap(err, err.Error()))
+		}
+	}
+	statsd.Gauge(fmt.Sprintf("workers.%s.pool_size", state.worker()), size)
+}
+
+// desiredPoolSize decides how many minions we need for the given backlog. It grows
+// straight to what the backlog needs but shrinks one minion at a time to avoid flapping.
+func desiredPoolSize(cfg AutoscaleConfig, depth int, latency time.Duration, current int) int {
+	wanted := (depth + cfg.MessagesPerWorker - 1) / cfg.MessagesPerWorker
+	if cfg.TargetLatency > 0 && latency > cfg.TargetLatency && depth > 0 && wanted <= current {
+		wanted = current + 1
+	}
+	if wanted < current {
+		wanted = current - 1
+	}
+	return clampPoolSize(cfg, wanted)
+}
+
+func clampPoolSize(cfg AutoscaleConfig, size int) int {
+	if size < cfg.MinWorkers {
+		return cfg.MinWorkers
+	}
+	if size > cfg.MaxWorkers {
+		return cfg.MaxWorkers
+	}
+	return size
+}
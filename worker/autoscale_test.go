@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDesiredPoolSize(t *testing.T) {
+	cfg := AutoscaleConfig{MinWorkers: 2, MaxWorkers: 10, MessagesPerWorker: 100, TargetLatency: time.Second}
+	cases := []struct {
+		depth   int
+		latency time.Duration
+		current int
+		wanted  int
+	}{
+		{0, 0, 2, 2},                 // never below min
+		{550, 0, 2, 6},               // grow to what the backlog needs
+		{5000, 0, 2, 10},             // never above max
+		{0, 0, 6, 5},                 // shrink one at a time
+		{150, 2 * time.Second, 2, 3}, // slow tasks with a backlog grow the pool
+		{0, 2 * time.Second, 4, 3},   // slow tasks without a backlog don't
+		{150, 500 * time.Millisecond, 2, 2},
+	}
+	for _, c := range cases {
+		if got := desiredPoolSize(cfg, c.depth, c.latency, c.current); got != c.wanted {
+			t.Errorf("depth %d latency %s current %d: expected %d got %d", c.depth, c.latency, c.current, c.wanted, got)
+		}
+	}
+}
+
+func TestEnableAutoscalingValidates(t *testing.T) {
+	defer func() { autoscaling = nil }()
+	if err := EnableAutoscaling(AutoscaleConfig{MinWorkers: 5, MaxWorkers: 2, MessagesPerWorker: 1}); err == nil {
+		t.Error("Expected an error for max below min")
+	}
+	if err := EnableAutoscaling(AutoscaleConfig{MinWorkers: 1, MaxWorkers: 2, MessagesPerWorker: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if autoscaling.Interval != 10*time.Second {
+		t.Errorf("Expected default interval got %s", autoscaling.Interval)
+	}
+}
+
+type depthCounter struct {
+	Broker
+	calls chan int
+}
+
+func (b *depthCounter) QueueDepth(queueName string) (int, error) {
+	b.calls <- 0
+	return 0, nil
+}
+
+func (b *depthCounter) SetPrefetch(prefetch int) error {
+	return nil
+}
+
+func TestDrainStopsAutoscaling(t *testing.T) {
+	defer func() { autoscaling = nil }()
+	defer SetBroker(currentBroker())
+	b := &depthCounter{calls: make(chan int, 100)}
+	SetBroker(b)
+	EnableAutoscaling(AutoscaleConfig{MinWorkers: 1, MaxWorkers: 2, MessagesPerWorker: 1, Interval: 5 * time.Millisecond})
+	minions := newPool(make(chan *Event), 1)
+	defer minions.resize(0)
+	state.start("autoscaled", "queue", minions)
+	defer state.start("", "", nil)
+
+	state.startAutoscaler()
+	defer state.stopAutoscaler()
+	<-b.calls
+	if err := Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// a tick may have been on its way
+	time.Sleep(20 * time.Millisecond)
+	for len(b.calls) > 0 {
+		<-b.calls
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(b.calls) != 0 {
+		t.Error("Expected the autoscaler to stop on drain")
+	}
+
+	Resume()
+	select {
+	case <-b.calls:
+	case <-time.After(time.Second):
+		t.Error("Expected the autoscaler to start again on resume")
+	}
+}
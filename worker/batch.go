@@ -0,0 +1,182 @@
+package worker
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/statsd"
+	"github.com/roeepolegfiverr/gofiverr/tracing"
+)
+
+// BatchTask handles several events of the same name at once, e.g. a bulk insert.
+// It must return one result per event, in the same order, nil for the events that
+// succeeded. Failed events are sent to the failed queue, the rest are just acked.
+type BatchTask func([]*Event) []error
+
+type batchTask struct {
+	task    BatchTask
+	size    int
+	maxWait time.Duration
+	events  chan *Event
+	// flushNow makes the batch being collected run right away, see flushBatches.
+	flushNow chan struct{}
+}
+
+// AddBatchTask registers a batch task for key. The task gets up to size events, or
+// whatever arrived within maxWait of the first one. Since messages are only acked
+// after their batch is done, the channel prefetch should be at least size.
+func (tasks *WorkerTasks) AddBatchTask(key string, task BatchTask, size int, maxWait time.Duration) bool {
+	state.Lock()
+	defer state.Unlock()
+	if tasks.BatchTasks == nil {
+		tasks.BatchTasks = map[string]*batchTask{}
+	}
+	if _, ok := tasks.Tasks[key]; ok {
+		return false
+	}
+	if _, ok := tasks.BatchTasks[key]; ok {
+		return false
+	}
+	if size < 1 {
+		size = 1
+	}
+	tasks.BatchTasks[key] = &batchTask{
+		task:     task,
+		size:     size,
+		maxWait:  maxWait,
+		events:   make(chan *Event, size),
+		flushNow: make(chan struct{}, 1),
+	}
+	return true
+}
+
+// startBatchers starts one goroutine per batch task, collecting and flushing its batches.
+func startBatchers() {
+	state.Lock()
+	defer state.Unlock()
+	for name, batch := range Tasks.BatchTasks {
+		go batch.run(name)
+	}
+}
+
+// flushBatches runs the batches being collected without waiting for them to fill up.
+func flushBatches() {
+	state.Lock()
+	defer state.Unlock()
+	for _, batch := range Tasks.BatchTasks {
+		select {
+		case batch.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (batch *batchTask) run(name string) {
+	for {
+		events := collectBatch(batch.events, batch.size, batch.maxWait, batch.flushNow)
+		if events == nil {
+			return
+		}
+		batch.flush(name, events)
+	}
+}
+
+// collectBatch waits for a first event and then keeps collecting until there are size
+// events, maxWait has passed or flush is signaled. It returns nil once events is closed
+// and drained.
+func collectBatch(events <-chan *Event, size int, maxWait time.Duration, flush <-chan struct{}) []*Event {
+	first, ok := <-events
+	if !ok {
+		return nil
+	}
+	batch := []*Event{first}
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
+	for len(batch) < size {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, event)
+		case <-timeout.C:
+			return batch
+		case <-flush:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (batch *batchTask) flush(name string, events []*Event) {
+	jobIDs := make([]uint64, len(events))
+	spans := make([]trace.Span, len(events))
+	for i, event := range events {
+		jobIDs[i] = state.startQueuedJob(-1, event)
+		event.Context, spans[i] = tracing.StartConsumeSpan(event.Context, state.queue(), name)
+		notifyStarted(event)
+	}
+	start := time.Now()
+	var results []error
+	statsd.StatsDWrapper(name, func() error {
+		results = runBatch(batch.task, events)
+		for _, err := range results {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})()
+	elapsed := time.Since(start)
+
+	for i, event := range events {
+		err := results[i]
+		if err != nil {
+			logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("Batch task %s failed for an event", name)))
+			sendToFailedQueue(event.OriginalMessage, err)
+		}
+		event.OriginalMessage.Ack(false)
+		state.finishJob(jobIDs[i], name, err, elapsed)
+		tracing.EndSpan(spans[i], err)
+		notifyDone(event, elapsed, err)
+		recordResult(err)
+	}
+}
+
+// rejectBatchEvent sends an event of a batch task that couldn't be upcast or validated
+// straight to the failed queue and acks it.
+func rejectBatchEvent(event *Event, err error) {
+	jobID := state.startQueuedJob(-1, event)
+	logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("Event %s can't be batched", event.Name)))
+	sendToFailedQueue(event.OriginalMessage, err)
+	event.OriginalMessage.Ack(false)
+	state.finishJob(jobID, event.Name, err, 0)
+	notifyDone(event, 0, err)
+	recordResult(err)
+}
+
+// runBatch invokes the task and makes sure there is exactly one result per event,
+// failing the whole batch if the task panics or returns the wrong number of results.
+func runBatch(task BatchTask, events []*Event) (results []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			results = failAll(events, errors.Newf("Batch task panicked: %v", r))
+		}
+	}()
+
+	results = task(events)
+	if len(results) != len(events) {
+		return failAll(events, errors.Newf("Batch task returned %d results for %d events", len(results), len(events)))
+	}
+	return results
+}
+
+func failAll(events []*Event, err error) []error {
+	results := make([]error, len(events))
+	for i := range results {
+		results[i] = err
+	}
+	return results
+}
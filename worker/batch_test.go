@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCollectBatchBySize(t *testing.T) {
+	events := make(chan *Event, 5)
+	for i := 0; i < 5; i++ {
+		events <- &Event{Name: "bulk"}
+	}
+	if batch := collectBatch(events, 3, time.Minute, nil); len(batch) != 3 {
+		t.Errorf("Expected a full batch of 3 got %d", len(batch))
+	}
+}
+
+func TestCollectBatchByWait(t *testing.T) {
+	events := make(chan *Event, 5)
+	events <- &Event{Name: "bulk"}
+	events <- &Event{Name: "bulk"}
+	start := time.Now()
+	batch := collectBatch(events, 10, 20*time.Millisecond, nil)
+	if len(batch) != 2 {
+		t.Errorf("Expected a partial batch of 2 got %d", len(batch))
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected to wait for more events")
+	}
+	close(events)
+	if batch := collectBatch(events, 10, time.Minute, nil); batch != nil {
+		t.Errorf("Expected no batch from a closed channel got %d", len(batch))
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	events := []*Event{{Name: "bulk"}, {Name: "bulk"}}
+
+	results := runBatch(func(events []*Event) []error {
+		return []error{nil, errors.New("bad row")}
+	}, events)
+	if results[0] != nil || results[1] == nil {
+		t.Errorf("Expected only the second event to fail got %v", results)
+	}
+
+	results = runBatch(func(events []*Event) []error {
+		return nil
+	}, events)
+	if results[0] == nil || results[1] == nil {
+		t.Errorf("Expected a missing result to fail the batch got %v", results)
+	}
+
+	results = runBatch(func(events []*Event) []error {
+		panic("boom")
+	}, events)
+	if results[0] == nil || results[1] == nil {
+		t.Errorf("Expected a panic to fail the batch got %v", results)
+	}
+}
+
+func TestCollectBatchFlush(t *testing.T) {
+	events := make(chan *Event, 5)
+	flush := make(chan struct{}, 1)
+	events <- &Event{Name: "bulk"}
+	flush <- struct{}{}
+	start := time.Now()
+	if batch := collectBatch(events, 10, time.Minute, flush); len(batch) != 1 {
+		t.Errorf("Expected the batch so far got %d events", len(batch))
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected the flush not to wait for maxWait")
+	}
+}
@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+	"github.com/roeepolegfiverr/gofiverr/statsd"
+)
+
+// infrastructureError marks a failure caused by a dependency being down, as opposed
+// to a bad event. Only those count towards opening the circuit breaker.
+type infrastructureError struct {
+	errors.FiverrError
+}
+
+// InfrastructureError wraps err to tell the circuit breaker a dependency such as
+// MySQL or an internal API is failing, e.g.
+//
+//	if err := db.Ping(); err != nil {
+//		return worker.InfrastructureError(err)
+//	}
+func InfrastructureError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &infrastructureError{errors.Wrap(err, errorMessage(err))}
+}
+
+// IsInfrastructureError tells whether err, or any error it wraps, is an InfrastructureError.
+func IsInfrastructureError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*infrastructureError); ok {
+			return true
+		}
+		fiverrErr, ok := err.(errors.FiverrError)
+		if !ok {
+			return false
+		}
+		err = fiverrErr.GetInner()
+	}
+	return false
+}
+
+// BreakerConfig configures the worker circuit breaker.
+type BreakerConfig struct {
+	// Threshold is the number of infrastructure failures in a row that opens the circuit.
+	Threshold int
+	// Probe checks whether the dependencies are back, e.g. pinging MySQL.
+	Probe func() error
+	// ProbeInterval is how often Probe runs while the circuit is open. Defaults to 10 seconds.
+	ProbeInterval time.Duration
+	// Classify tells infrastructure failures apart. Defaults to IsInfrastructureError.
+	Classify func(error) bool
+}
+
+// circuitBreaker pauses consumption after too many infrastructure failures and resumes
+// it once the probe succeeds.
+type circuitBreaker struct {
+	sync.Mutex
+	config   BreakerConfig
+	failures int
+	open     bool
+	pause    func() error
+	resume   func()
+}
+
+var breaker *circuitBreaker
+
+// EnableCircuitBreaker makes the worker stop pulling messages when its dependencies are
+// down instead of sending every message to the failed queue. Call it before Consume.
+func EnableCircuitBreaker(config BreakerConfig) error {
+	if config.Threshold < 1 {
+		return errors.Newf("Breaker threshold must be positive, got %d", config.Threshold)
+	}
+	if config.Probe == nil {
+		return errors.New("Breaker needs a probe to know when to resume")
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = 10 * time.Second
+	}
+	if config.Classify == nil {
+		config.Classify = IsInfrastructureError
+	}
+	// only take back our own pause, an admin or a drain may have paused the worker too
+	breaker = newCircuitBreaker(config, func() error {
+		return state.pause(pausedByBreaker)
+	}, func() {
+		state.unpause(pausedByBreaker)
+	})
+	return nil
+}
+
+func newCircuitBreaker(config BreakerConfig, pause func() error, resume func()) *circuitBreaker {
+	return &circuitBreaker{config: config, pause: pause, resume: resume}
+}
+
+// recordResult is called with the outcome of every job.
+func recordResult(err error) {
+	if breaker != nil {
+		breaker.record(err)
+	}
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.open {
+		return
+	}
+	if err == nil || !b.config.Classify(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < b.config.Threshold {
+		return
+	}
+
+	b.open = true
+	logger.ErrorLog(errors.Wrapf(err, "Circuit breaker opened after %d infrastructure failures, pausing worker %s", b.failures, state.worker()))
+	statsd.Gauge(fmt.Sprintf("workers.%s.circuit_open", state.worker()), 1)
+	if pauseErr := b.pause(); pauseErr != nil {
+		logger.ErrorLog(errors.Wrap(pauseErr, pauseErr.Error()))
+	}
+	go b.probe()
+}
+
+// probe runs until the dependencies are back and then closes the circuit.
+func (b *circuitBreaker) probe() {
+	ticker := time.NewTicker(b.config.ProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := b.config.Probe(); err != nil {
+			fmt.Printf("Circuit breaker probe failed, worker %s stays paused: %s\n", state.worker(), errorMessage(err))
+			continue
+		}
+		b.close()
+		return
+	}
+}
+
+func (b *circuitBreaker) close() {
+	b.Lock()
+	defer b.Unlock()
+	b.open = false
+	b.failures = 0
+	fmt.Printf("Circuit breaker closed, resuming worker %s\n", state.worker())
+	statsd.Gauge(fmt.Sprintf("workers.%s.circuit_open", state.worker()), 0)
+	b.resume()
+}
+
+func errorMessage(err error) string {
+	if fiverrErr, ok := err.(errors.FiverrError); ok {
+		return fiverrErr.GetMessage()
+	}
+	return err.Error()
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsInfrastructureError(t *testing.T) {
+	err := InfrastructureError(errors.New("connection refused"))
+	if !IsInfrastructureError(err) {
+		t.Error("Expected an infrastructure error")
+	}
+	if IsInfrastructureError(errors.New("bad event")) {
+		t.Error("Expected a plain error not to be an infrastructure error")
+	}
+	if InfrastructureError(nil) != nil {
+		t.Error("Expected nil to stay nil")
+	}
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	var lock sync.Mutex
+	paused, resumed := 0, make(chan bool, 1)
+	probeErr := errors.New("still down")
+	b := newCircuitBreaker(BreakerConfig{
+		Threshold:     3,
+		ProbeInterval: 5 * time.Millisecond,
+		Classify:      IsInfrastructureError,
+		Probe: func() error {
+			lock.Lock()
+			defer lock.Unlock()
+			return probeErr
+		},
+	}, func() error {
+		paused++
+		return nil
+	}, func() {
+		resumed <- true
+	})
+
+	down := InfrastructureError(errors.New("mysql is down"))
+	b.record(down)
+	b.record(down)
+	b.record(errors.New("bad event")) // resets the count
+	b.record(down)
+	b.record(down)
+	if paused != 0 {
+		t.Fatal("Expected the breaker to stay closed")
+	}
+	b.record(down)
+	if paused != 1 {
+		t.Fatalf("Expected the breaker to pause the worker once got %d", paused)
+	}
+
+	select {
+	case <-resumed:
+		t.Fatal("Expected the breaker to stay open while the probe fails")
+	case <-time.After(20 * time.Millisecond):
+	}
+	lock.Lock()
+	probeErr = nil
+	lock.Unlock()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the breaker to resume the worker")
+	}
+}
@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"github.com/streadway/amqp"
+	"sync"
+	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// Broker is where the worker pulls messages from. Messages are handed over as
+// amqp.Delivery whatever the backend is, so tasks and Event stay the same; non
+// rabbit backends ack through the delivery Acknowledger.
+type Broker interface {
+	// Consume starts delivering the messages of queueName. The returned channel is
+	// closed when consuming stops, after Cancel or a failure.
+	Consume(queueName, consumerName string) (<-chan amqp.Delivery, error)
+	// Cancel stops delivering messages to consumerName.
+	Cancel(consumerName string) error
+	// SetPrefetch limits how many unacked messages may be delivered at once. It
+	// applies to the running consumer and the ones started later.
+	SetPrefetch(prefetch int) error
+	// QueueDepth returns how many messages are waiting to be delivered.
+	QueueDepth(queueName string) (int, error)
+}
+
+var (
+	brokerLock sync.Mutex
+	broker     Broker = &rabbitBroker{}
+)
+
+// SetBroker changes the backend Consume pulls messages from. Defaults to RabbitMQ
+// through connectors.Clients.Rabbit(). Call it before Consume.
+func SetBroker(b Broker) {
+	brokerLock.Lock()
+	defer brokerLock.Unlock()
+	broker = b
+}
+
+func currentBroker() Broker {
+	brokerLock.Lock()
+	defer brokerLock.Unlock()
+	return broker
+}
+
+// rabbitBroker consumes from RabbitMQ on the shared connectors channel.
+type rabbitBroker struct {
+	sync.Mutex
+	channel  *amqp.Channel
+	prefetch int
+	// inspect is a channel of our own, a failed passive declare closes the channel.
+	inspect *amqp.Channel
+}
+
+func (rabbit *rabbitBroker) Consume(queueName, consumerName string) (<-chan amqp.Delivery, error) {
+	rabbit.Lock()
+	defer rabbit.Unlock()
+	rabbit.channel = connectors.Clients.Rabbit()
+	if err := rabbit.applyPrefetch(); err != nil {
+		return nil, err
+	}
+	return rabbit.channel.Consume(queueName, consumerName, false, false, false, false, nil)
+}
+
+func (rabbit *rabbitBroker) Cancel(consumerName string) error {
+	rabbit.Lock()
+	defer rabbit.Unlock()
+	if rabbit.channel == nil {
+		return nil
+	}
+	return rabbit.channel.Cancel(consumerName, false)
+}
+
+func (rabbit *rabbitBroker) SetPrefetch(prefetch int) error {
+	rabbit.Lock()
+	defer rabbit.Unlock()
+	rabbit.prefetch = prefetch
+	if rabbit.channel == nil {
+		return nil
+	}
+	return rabbit.applyPrefetch()
+}
+
+// applyPrefetch sets a global prefetch, so changing it affects the running consumer too.
+func (rabbit *rabbitBroker) applyPrefetch() error {
+	if rabbit.prefetch <= 0 {
+		return nil
+	}
+	if err := rabbit.channel.Qos(rabbit.prefetch, 0, true); err != nil {
+		return errors.Wrap(err, "Couldn't set prefetch")
+	}
+	return nil
+}
+
+func (rabbit *rabbitBroker) QueueDepth(queueName string) (int, error) {
+	rabbit.Lock()
+	defer rabbit.Unlock()
+	if rabbit.inspect == nil {
+		channel, err := connectors.Clients.NewRabbitChannel()
+		if err != nil {
+			return 0, err
+		}
+		rabbit.inspect = channel
+	}
+	queue, err := rabbit.inspect.QueueDeclarePassive(queueName, true, false, false, false, nil)
+	if err != nil {
+		rabbit.inspect.Close()
+		rabbit.inspect = nil
+		return 0, errors.Wrap(err, "Couldn't inspect queue")
+	}
+	return queue.Messages, nil
+}
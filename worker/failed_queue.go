@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// FailedQueueRetention is how long failed messages are kept before mongo expires
+// them. Zero keeps them forever. Set it before Consume.
+//
+// The retention is set when the created_at index is first created. Mongo refuses to
+// change it on an existing index, so after changing FailedQueueRetention either run
+// collMod on the created_at_1 index with the new expireAfterSeconds, or drop it and
+// let the worker create it again.
+var FailedQueueRetention = 30 * 24 * time.Hour
+
+// FailedQueueCountsRetention is how long the hourly failure counts are kept, they
+// outlive the failed messages they count. Changing it works like FailedQueueRetention,
+// on the hour_1 index.
+var FailedQueueCountsRetention = 90 * 24 * time.Hour
+
+// FailedQueueGroup is a group of failures of the same event with the same error.
+type FailedQueueGroup struct {
+	Event        string    `bson:"event" json:"event"`
+	Fingerprint  string    `bson:"fingerprint" json:"fingerprint"`
+	ErrorMessage string    `bson:"error_message" json:"error_message"`
+	Count        int       `bson:"count" json:"count"`
+	LastSeen     time.Time `bson:"last_seen" json:"last_seen"`
+}
+
+var (
+	failedIndexesLock sync.Mutex
+	failedIndexed     = map[string]*sync.Once{}
+	// ids, hashes and numbers vary between otherwise identical errors
+	volatileParts = regexp.MustCompile(`[0-9a-fA-F]{24,}|[0-9a-fA-F-]{36}|\d+`)
+)
+
+func failedQueueName() string {
+	return fmt.Sprintf("%s_failed_queue", state.worker())
+}
+
+// failedCountsName is the collection counting the failures of each fingerprint per hour.
+func failedCountsName() string {
+	return fmt.Sprintf("%s_failed_queue_counts", state.worker())
+}
+
+// ensureFailedQueueIndexes creates the retention and query indexes, once per collection.
+// A failure is logged once and not retried, failed messages are still stored.
+func ensureFailedQueueIndexes(collection *mgo.Collection, create func(collection *mgo.Collection)) {
+	failedIndexesLock.Lock()
+	once, ok := failedIndexed[collection.FullName]
+	if !ok {
+		once = &sync.Once{}
+		failedIndexed[collection.FullName] = once
+	}
+	failedIndexesLock.Unlock()
+	once.Do(func() { create(collection) })
+}
+
+func createFailedQueueIndexes(collection *mgo.Collection) {
+	createdAt := mgo.Index{Key: []string{"created_at"}, Background: true}
+	if FailedQueueRetention > 0 {
+		createdAt.ExpireAfter = FailedQueueRetention
+	}
+	ensureIndexes(collection, []mgo.Index{
+		createdAt,
+		{Key: []string{"event", "created_at"}, Background: true},
+		{Key: []string{"fingerprint", "created_at"}, Background: true},
+	})
+}
+
+func createFailedCountsIndexes(collection *mgo.Collection) {
+	hour := mgo.Index{Key: []string{"hour"}, Background: true}
+	if FailedQueueCountsRetention > 0 {
+		hour.ExpireAfter = FailedQueueCountsRetention
+	}
+	ensureIndexes(collection, []mgo.Index{hour})
+}
+
+func ensureIndexes(collection *mgo.Collection, indexes []mgo.Index) {
+	for _, index := range indexes {
+		if err := collection.EnsureIndex(index); err != nil {
+			logger.ErrorLog(errors.Wrap(err, fmt.Sprintf("Couldn't create index %v on %s, see FailedQueueRetention", index.Key, collection.FullName)))
+		}
+	}
+}
+
+// errorFingerprint identifies an error of an event regardless of the ids and numbers
+// in its message, so failures with the same cause are grouped together.
+func errorFingerprint(eventName string, message string) string {
+	sum := sha1.Sum([]byte(eventName + "|" + volatileParts.ReplaceAllString(message, "?")))
+	return hex.EncodeToString(sum[:])
+}
+
+// countFailure adds a failure to the count of its fingerprint for the hour it happened in.
+func countFailure(collection *mgo.Collection, eventName string, fingerprint string, message string, at time.Time) error {
+	selector, update := failureCount(eventName, fingerprint, message, at)
+	_, err := collection.Upsert(selector, update)
+	return err
+}
+
+func failureCount(eventName string, fingerprint string, message string, at time.Time) (selector bson.M, update bson.M) {
+	hour := at.Truncate(time.Hour)
+	selector = bson.M{"_id": fmt.Sprintf("%s-%d", fingerprint, hour.Unix())}
+	update = bson.M{
+		"$inc": bson.M{"count": 1},
+		"$set": bson.M{"error_message": message, "last_seen": at},
+		"$setOnInsert": bson.M{
+			"event":       eventName,
+			"fingerprint": fingerprint,
+			"hour":        hour,
+		},
+	}
+	return selector, update
+}
+
+// FailedQueueSummary returns the most common failures since the given time, e.g. the
+// top failing events in the last hour, most frequent first. Failures are counted per
+// hour, so since is rounded down to the hour. The counts are kept for
+// FailedQueueCountsRetention, whether the failed messages are still there or not.
+func FailedQueueSummary(since time.Time, limit int) ([]FailedQueueGroup, error) {
+	session, err := connectors.Clients.NamedMongo("failed_queue")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	groups := []FailedQueueGroup{}
+	pipeline := failedQueueSummaryPipeline(since, limit)
+	if err := session.DB("").C(failedCountsName()).Pipe(pipeline).All(&groups); err != nil {
+		return nil, errors.Wrap(err, "Couldn't summarize the failed queue")
+	}
+	return groups, nil
+}
+
+func failedQueueSummaryPipeline(since time.Time, limit int) []bson.M {
+	if limit <= 0 {
+		limit = 10
+	}
+	return []bson.M{
+		{"$match": bson.M{"hour": bson.M{"$gte": since.Truncate(time.Hour)}}},
+		{"$sort": bson.M{"last_seen": -1}},
+		{"$group": bson.M{
+			"_id":           "$fingerprint",
+			"event":         bson.M{"$first": "$event"},
+			"fingerprint":   bson.M{"$first": "$fingerprint"},
+			"error_message": bson.M{"$first": "$error_message"},
+			"count":         bson.M{"$sum": "$count"},
+			"last_seen":     bson.M{"$first": "$last_seen"},
+		}},
+		{"$sort": bson.M{"count": -1}},
+		{"$limit": limit},
+	}
+}
@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestErrorFingerprintIgnoresIds(t *testing.T) {
+	first := errorFingerprint("order_created", "Couldn't find order 1234 for user 5b8f1c2a9d3e4f5a6b7c8d9e")
+	second := errorFingerprint("order_created", "Couldn't find order 98 for user 5c0a1b2c3d4e5f6a7b8c9d0e")
+	if first != second {
+		t.Errorf("Expected the same fingerprint for errors differing only by ids")
+	}
+	if other := errorFingerprint("order_paid", "Couldn't find order 1234 for user 5b8f1c2a9d3e4f5a6b7c8d9e"); other == first {
+		t.Errorf("Expected different fingerprints for different events")
+	}
+	if other := errorFingerprint("order_created", "Timeout"); other == first {
+		t.Errorf("Expected different fingerprints for different errors")
+	}
+}
+
+func TestFailureCountPerHour(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 42, 0, 0, time.UTC)
+	selector, update := failureCount("order_created", "abc", "Timeout", at)
+	later, _ := failureCount("order_created", "abc", "Timeout", at.Add(10*time.Minute))
+	if !reflect.DeepEqual(selector, later) {
+		t.Errorf("Expected failures of the same hour to be counted together got %v and %v", selector, later)
+	}
+	if next, _ := failureCount("order_created", "abc", "Timeout", at.Add(time.Hour)); reflect.DeepEqual(selector, next) {
+		t.Errorf("Expected the next hour to be counted apart")
+	}
+	if update["$inc"].(bson.M)["count"] != 1 || update["$set"].(bson.M)["last_seen"] != at {
+		t.Errorf("Unexpected update %v", update)
+	}
+	if hour := update["$setOnInsert"].(bson.M)["hour"]; hour != time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC) {
+		t.Errorf("Expected the count to be for 10:00 got %v", hour)
+	}
+}
+
+func TestFailedQueueSummaryPipeline(t *testing.T) {
+	since := time.Date(2024, 5, 1, 10, 42, 0, 0, time.UTC)
+	pipeline := failedQueueSummaryPipeline(since, 0)
+
+	match := pipeline[0]["$match"].(bson.M)["hour"].(bson.M)["$gte"]
+	if match != time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC) {
+		t.Errorf("Expected the counts since 10:00 got %v", match)
+	}
+	group := pipeline[2]["$group"].(bson.M)
+	if group["_id"] != "$fingerprint" || !reflect.DeepEqual(group["count"], bson.M{"$sum": "$count"}) {
+		t.Errorf("Expected the hourly counts to be summed per fingerprint got %v", group)
+	}
+	if !reflect.DeepEqual(pipeline[3], bson.M{"$sort": bson.M{"count": -1}}) || pipeline[4]["$limit"] != 10 {
+		t.Errorf("Expected the 10 most frequent failures got %v", pipeline[3:])
+	}
+}
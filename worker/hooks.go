@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"github.com/streadway/amqp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hooks are callbacks on the lifecycle of every event, for tests and custom telemetry.
+// Any of them may be nil. They are called in order on a goroutine of their own, so a
+// slow hook never holds up the worker: when hooks fall too far behind, calls are
+// dropped and counted in Status. Hooks get a copy of the event as it was when the
+// hook was queued.
+type Hooks struct {
+	// OnReceived is called for every message pulled from the queue, except the ones
+	// put back because the worker is paused, it is called when they come back.
+	OnReceived func(event *Event)
+	// OnRetried is called for messages rabbit delivers again, e.g. after a reconnect.
+	OnRetried func(event *Event)
+	// OnStarted is called when a minion starts working on the event.
+	OnStarted func(event *Event)
+	// OnSucceeded and OnFailed are called when the task is done.
+	OnSucceeded func(event *Event, elapsed time.Duration)
+	OnFailed    func(event *Event, elapsed time.Duration, err error)
+	// OnAcked is called once the message is acked, after a failed event went to the
+	// failed queue. err is the task error, if any.
+	OnAcked func(event *Event, elapsed time.Duration, err error)
+}
+
+const hookQueueSize = 1024
+
+// hookDispatcher runs the registered hooks from a queue of its own.
+type hookDispatcher struct {
+	sync.RWMutex
+	hooks   []Hooks
+	calls   chan func()
+	dropped int64
+	// done is closed once stop ran every call queued before it.
+	done chan struct{}
+}
+
+var dispatcher = newHookDispatcher(hookQueueSize)
+
+func newHookDispatcher(queueSize int) *hookDispatcher {
+	return &hookDispatcher{
+		calls: make(chan func(), queueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// AddHooks registers callbacks on the lifecycle of every event.
+func AddHooks(h Hooks) {
+	dispatcher.add(h)
+}
+
+func (d *hookDispatcher) add(h Hooks) {
+	d.Lock()
+	defer d.Unlock()
+	if d.hooks == nil {
+		go d.run()
+	}
+	d.hooks = append(d.hooks, h)
+}
+
+func (d *hookDispatcher) run() {
+	defer close(d.done)
+	for call := range d.calls {
+		call()
+	}
+}
+
+// stop forgets the hooks and returns a channel closed once the calls already queued
+// ran.
+func (d *hookDispatcher) stop() <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	if d.hooks == nil {
+		close(d.done)
+	} else {
+		close(d.calls)
+	}
+	d.hooks = nil
+	return d.done
+}
+
+func (d *hookDispatcher) droppedCalls() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+// notify queues a call to every registered hook selected by pick, without blocking.
+// The hooks get a copy of event taken now, as the minion goes on changing the event
+// while they run.
+func notify(event *Event, pick func(h Hooks, event *Event) func()) {
+	dispatcher.notify(event, pick)
+}
+
+func (d *hookDispatcher) notify(event *Event, pick func(h Hooks, event *Event) func()) {
+	d.RLock()
+	defer d.RUnlock()
+	if len(d.hooks) == 0 {
+		return
+	}
+	snapshot := snapshotEvent(event)
+	for _, h := range d.hooks {
+		call := pick(h, snapshot)
+		if call == nil {
+			continue
+		}
+		select {
+		case d.calls <- call:
+		default:
+			atomic.AddInt64(&d.dropped, 1)
+		}
+	}
+}
+
+// snapshotEvent copies event deep enough that changes to its params or headers
+// don't show through.
+func snapshotEvent(event *Event) *Event {
+	snapshot := *event
+	if event.Params != nil {
+		snapshot.Params = copyValue(event.Params).(map[string]interface{})
+	}
+	if event.OriginalMessage.Headers != nil {
+		snapshot.OriginalMessage.Headers = copyValue(event.OriginalMessage.Headers).(amqp.Table)
+	}
+	return &snapshot
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = copyValue(item)
+		}
+		return copied
+	case amqp.Table:
+		copied := make(amqp.Table, len(v))
+		for key, item := range v {
+			copied[key] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// notifyListener hands event to the listener of Consume if it is ready for it, events
+// it isn't waiting for are dropped and counted with the hook calls.
+func notifyListener(listener chan *Event, event *Event) {
+	if listener == nil {
+		return
+	}
+	select {
+	case listener <- event:
+	default:
+		atomic.AddInt64(&dispatcher.dropped, 1)
+	}
+}
+
+func notifyReceived(event *Event) {
+	notify(event, func(h Hooks, event *Event) func() {
+		if h.OnReceived == nil {
+			return nil
+		}
+		return func() { h.OnReceived(event) }
+	})
+	if event.OriginalMessage.Redelivered {
+		notify(event, func(h Hooks, event *Event) func() {
+			if h.OnRetried == nil {
+				return nil
+			}
+			return func() { h.OnRetried(event) }
+		})
+	}
+}
+
+func notifyStarted(event *Event) {
+	notify(event, func(h Hooks, event *Event) func() {
+		if h.OnStarted == nil {
+			return nil
+		}
+		return func() { h.OnStarted(event) }
+	})
+}
+
+// notifyDone reports the outcome of the task and then the ack.
+func notifyDone(event *Event, elapsed time.Duration, err error) {
+	notify(event, func(h Hooks, event *Event) func() {
+		if err == nil && h.OnSucceeded != nil {
+			return func() { h.OnSucceeded(event, elapsed) }
+		}
+		if err != nil && h.OnFailed != nil {
+			return func() { h.OnFailed(event, elapsed, err) }
+		}
+		return nil
+	})
+	notify(event, func(h Hooks, event *Event) func() {
+		if h.OnAcked == nil {
+			return nil
+		}
+		return func() { h.OnAcked(event, elapsed, err) }
+	})
+}
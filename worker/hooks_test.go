@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useHookDispatcher gives the test hooks of its own, and waits for their calls to be
+// done once it is over.
+func useHookDispatcher(t *testing.T) {
+	previous := dispatcher
+	dispatcher = newHookDispatcher(hookQueueSize)
+	t.Cleanup(func() {
+		stopped := dispatcher.stop()
+		dispatcher = previous
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Error("Timed out waiting for the hook calls to be done")
+		}
+	})
+}
+
+func TestHooksAreCalledInOrder(t *testing.T) {
+	useHookDispatcher(t)
+	calls := make(chan string, 10)
+	AddHooks(Hooks{
+		OnReceived: func(event *Event) { calls <- "received " + event.Name },
+		OnRetried:  func(event *Event) { calls <- "retried " + event.Name },
+		OnStarted:  func(event *Event) { calls <- "started " + event.Name },
+		OnSucceeded: func(event *Event, elapsed time.Duration) {
+			calls <- "succeeded " + event.Name
+		},
+		OnFailed: func(event *Event, elapsed time.Duration, err error) {
+			calls <- "failed " + event.Name + ": " + err.Error()
+		},
+		OnAcked: func(event *Event, elapsed time.Duration, err error) {
+			calls <- "acked " + event.Name
+		},
+	})
+
+	ok := &Event{Name: "ok"}
+	retried := &Event{Name: "retried", OriginalMessage: amqp.Delivery{Redelivered: true}}
+	notifyReceived(ok)
+	notifyStarted(ok)
+	notifyDone(ok, time.Millisecond, nil)
+	notifyReceived(retried)
+	notifyDone(retried, time.Millisecond, errors.New("boom"))
+
+	expected := []string{
+		"received ok", "started ok", "succeeded ok", "acked ok",
+		"received retried", "retried retried", "failed retried: boom", "acked retried",
+	}
+	got := []string{}
+	for range expected {
+		select {
+		case call := <-calls:
+			got = append(got, call)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out after %v", got)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v got %v", expected, got)
+	}
+}
+
+func TestSlowHooksDontBlock(t *testing.T) {
+	useHookDispatcher(t)
+	block := make(chan bool)
+	// runs before the cleanup waits for the queued calls
+	defer close(block)
+	AddHooks(Hooks{OnStarted: func(event *Event) { <-block }})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < hookQueueSize+10; i++ {
+			notifyStarted(&Event{Name: "slow"})
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected notifications not to block")
+	}
+	if CurrentStatus().DroppedHookCalls == 0 {
+		t.Error("Expected some hook calls to be dropped")
+	}
+}
+
+func TestHooksGetASnapshot(t *testing.T) {
+	useHookDispatcher(t)
+	seen := make(chan map[string]interface{}, 1)
+	AddHooks(Hooks{OnReceived: func(event *Event) {
+		seen <- event.Params
+	}})
+
+	event := &Event{Name: "order", Params: map[string]interface{}{"items": []interface{}{"gig"}}}
+	notifyReceived(event)
+	// the minion goes on working on the event, e.g. upcasting it
+	event.Params["version"] = 2.0
+	event.Params["items"].([]interface{})[0] = "changed"
+
+	var params map[string]interface{}
+	select {
+	case params = <-seen:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the hook")
+	}
+	if _, ok := params["version"]; ok || params["items"].([]interface{})[0] != "gig" {
+		t.Errorf("Expected the params as they were when the event was received got %v", params)
+	}
+}
+
+func TestListenerDoesntBlock(t *testing.T) {
+	useHookDispatcher(t)
+	listener := make(chan *Event, 1)
+	notifyListener(listener, &Event{Name: "first"})
+	notifyListener(listener, &Event{Name: "second"})
+	if event := <-listener; event.Name != "first" {
+		t.Errorf("Expected the first event got %s", event.Name)
+	}
+	if dropped := CurrentStatus().DroppedHookCalls; dropped != 1 {
+		t.Errorf("Expected the event nobody waited for to be dropped, got %d dropped", dropped)
+	}
+}
+
+func TestMessagesReceivedWhilePausedArentReported(t *testing.T) {
+	useHookDispatcher(t)
+	received := make(chan string, 10)
+	AddHooks(Hooks{OnReceived: func(event *Event) { received <- event.Name }})
+	listener := make(chan *Event, 10)
+
+	Pause()
+	ack := &nackCounter{}
+	receive(amqp.Delivery{Acknowledger: ack, Body: []byte(`{"event": "paused"}`)}, listener, nil)
+	Resume()
+	jobs := make(chan *Event, 1)
+	receive(amqp.Delivery{Acknowledger: ack, Body: []byte(`{"event": "resumed"}`)}, listener, jobs)
+	event := <-jobs
+	state.finishJob(state.startQueuedJob(0, event), event.Name, nil, 0)
+
+	select {
+	case name := <-received:
+		if name != "resumed" {
+			t.Errorf("Expected only the message worked on to be reported got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the message worked on to be reported")
+	}
+	if len(listener) != 1 || (<-listener).Name != "resumed" {
+		t.Error("Expected the listener to get only the message worked on")
+	}
+}
@@ -0,0 +1,379 @@
+package worker
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/streadway/amqp"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// NatsBroker consumes a JetStream stream, named after the queue, through a durable
+// pull consumer. The consumer is created on first use and kept when the worker stops,
+// so messages that were delivered but not acked are delivered again after AckWait.
+// Nacks with requeue are delivered again right away, nacks without requeue terminate
+// the message. The message body is the event JSON, headers are passed on with their
+// first value.
+type NatsBroker struct {
+	// URL is a comma separated list of NATS servers, defaults to nats.DefaultURL.
+	URL string
+	// Options are passed to nats.Connect, e.g. credentials or TLS.
+	Options []nats.Option
+	// Stream defaults to the queue name.
+	Stream string
+	// Subject filters the stream, it defaults to every subject of the stream.
+	Subject string
+	// Durable is the consumer name, shared by every worker of the queue. Defaults to
+	// the queue name.
+	Durable string
+	// Block is how long a fetch waits for new messages. Defaults to 2 seconds.
+	Block time.Duration
+	// AckWait is how long a message may stay unacked before it is delivered again.
+	// Defaults to 5 minutes, it should be longer than the slowest task.
+	AckWait time.Duration
+
+	lock      sync.Mutex
+	conn      *nats.Conn
+	js        nats.JetStreamContext
+	prefetch  int
+	consumers map[string]*natsConsumer
+}
+
+type natsConsumer struct {
+	broker     *NatsBroker
+	sub        *nats.Subscription
+	name       string
+	stream     string
+	durable    string
+	deliveries chan amqp.Delivery
+	stop       chan struct{}
+	lock       sync.Mutex
+	unacked    int
+}
+
+func (b *NatsBroker) Consume(queueName, consumerName string) (<-chan amqp.Delivery, error) {
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	stream, durable := b.names(queueName)
+	if err := b.ensureConsumer(js, stream, durable); err != nil {
+		return nil, err
+	}
+	// bound to a consumer we created, unsubscribing leaves the consumer in place
+	sub, err := js.PullSubscribe(b.Subject, durable, nats.Bind(stream, durable), nats.ManualAck())
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't subscribe to stream %s", stream))
+	}
+
+	consumer := &natsConsumer{
+		broker:     b,
+		sub:        sub,
+		name:       consumerName,
+		stream:     stream,
+		durable:    durable,
+		deliveries: make(chan amqp.Delivery),
+		stop:       make(chan struct{}),
+	}
+	b.lock.Lock()
+	if b.consumers == nil {
+		b.consumers = map[string]*natsConsumer{}
+	}
+	if old, ok := b.consumers[consumerName]; ok {
+		old.cancel()
+	}
+	b.consumers[consumerName] = consumer
+	b.lock.Unlock()
+
+	go consumer.run()
+	return consumer.deliveries, nil
+}
+
+func (b *NatsBroker) Cancel(consumerName string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if consumer, ok := b.consumers[consumerName]; ok {
+		consumer.cancel()
+		delete(b.consumers, consumerName)
+	}
+	return nil
+}
+
+// SetPrefetch limits the messages fetched while others are unacked. The limit on the
+// server, MaxAckPending, follows it on the consumers in use.
+func (b *NatsBroker) SetPrefetch(prefetch int) error {
+	b.lock.Lock()
+	b.prefetch = prefetch
+	js := b.js
+	consumers := []*natsConsumer{}
+	for _, consumer := range b.consumers {
+		consumers = append(consumers, consumer)
+	}
+	b.lock.Unlock()
+
+	if js == nil {
+		return nil
+	}
+	for _, consumer := range consumers {
+		if err := b.updateMaxAckPending(js, consumer.stream, consumer.durable, prefetch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueDepth returns the messages of the stream the consumer hasn't delivered yet.
+func (b *NatsBroker) QueueDepth(queueName string) (int, error) {
+	js, err := b.jetStream()
+	if err != nil {
+		return 0, err
+	}
+	stream, durable := b.names(queueName)
+	info, err := js.ConsumerInfo(stream, durable)
+	if err != nil {
+		return 0, errors.Wrap(err, "Couldn't inspect stream")
+	}
+	return int(info.NumPending), nil
+}
+
+// Close closes the connection to NATS, after the consumers were canceled.
+func (b *NatsBroker) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn, b.js = nil, nil
+	}
+}
+
+func (b *NatsBroker) jetStream() (nats.JetStreamContext, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.js != nil && !b.conn.IsClosed() {
+		return b.js, nil
+	}
+	url := b.URL
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url, b.Options...)
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+		return nil, errors.Wrap(err, "Couldn't connect to NATS")
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Couldn't use JetStream")
+	}
+	b.conn, b.js = conn, js
+	return js, nil
+}
+
+func (b *NatsBroker) names(queueName string) (stream string, durable string) {
+	stream, durable = b.Stream, b.Durable
+	if stream == "" {
+		stream = queueName
+	}
+	if durable == "" {
+		durable = queueName
+	}
+	return stream, durable
+}
+
+// ensureConsumer creates the durable consumer, or brings the MaxAckPending of the
+// existing one to the prefetch.
+func (b *NatsBroker) ensureConsumer(js nats.JetStreamContext, stream, durable string) error {
+	_, err := js.ConsumerInfo(stream, durable)
+	if err == nil {
+		return b.updateMaxAckPending(js, stream, durable, b.currentPrefetch())
+	}
+	if err != nats.ErrConsumerNotFound {
+		return errors.Wrap(err, fmt.Sprintf("Couldn't inspect consumer %s", durable))
+	}
+	_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       durable,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       b.ackWait(),
+		FilterSubject: b.Subject,
+		MaxAckPending: b.currentPrefetch(),
+	})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Couldn't create consumer %s", durable))
+	}
+	return nil
+}
+
+// updateMaxAckPending sets the MaxAckPending of an existing consumer to prefetch. No
+// prefetch leaves the consumer as it is.
+func (b *NatsBroker) updateMaxAckPending(js nats.JetStreamContext, stream, durable string, prefetch int) error {
+	if prefetch <= 0 {
+		return nil
+	}
+	info, err := js.ConsumerInfo(stream, durable)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Couldn't inspect consumer %s", durable))
+	}
+	if info.Config.MaxAckPending == prefetch {
+		return nil
+	}
+	config := info.Config
+	config.MaxAckPending = prefetch
+	if _, err := js.UpdateConsumer(stream, &config); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Couldn't update consumer %s", durable))
+	}
+	return nil
+}
+
+func (b *NatsBroker) currentPrefetch() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.prefetch
+}
+
+func (b *NatsBroker) block() time.Duration {
+	if b.Block <= 0 {
+		return 2 * time.Second
+	}
+	return b.Block
+}
+
+func (b *NatsBroker) ackWait() time.Duration {
+	if b.AckWait <= 0 {
+		return 5 * time.Minute
+	}
+	return b.AckWait
+}
+
+func (consumer *natsConsumer) cancel() {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	select {
+	case <-consumer.stop:
+	default:
+		close(consumer.stop)
+	}
+}
+
+func (consumer *natsConsumer) stopped() bool {
+	select {
+	case <-consumer.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (consumer *natsConsumer) run() {
+	defer close(consumer.deliveries)
+	defer consumer.sub.Unsubscribe()
+
+	for !consumer.stopped() {
+		count := consumer.available()
+		if count <= 0 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		messages, err := consumer.sub.Fetch(count, nats.MaxWait(consumer.broker.block()))
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			logger.ErrorLog(errors.Wrap(err, "Couldn't fetch from stream"))
+			return
+		}
+		for _, message := range messages {
+			if !consumer.deliver(message) {
+				return
+			}
+		}
+	}
+}
+
+// available is how many more messages may be fetched without going over the prefetch.
+func (consumer *natsConsumer) available() int {
+	prefetch := consumer.broker.currentPrefetch()
+	if prefetch <= 0 {
+		return defaultStreamReadCount
+	}
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	return prefetch - consumer.unacked
+}
+
+func (consumer *natsConsumer) deliver(message *nats.Msg) bool {
+	delivery := natsDelivery(message, &natsAcknowledger{consumer: consumer, message: message})
+	delivery.ConsumerTag = consumer.name
+	consumer.lock.Lock()
+	consumer.unacked++
+	consumer.lock.Unlock()
+	select {
+	case consumer.deliveries <- delivery:
+		return true
+	case <-consumer.stop:
+		// not acked, the server delivers it again after AckWait
+		return false
+	}
+}
+
+// natsDelivery turns a JetStream message into the delivery the worker expects.
+func natsDelivery(message *nats.Msg, acknowledger amqp.Acknowledger) amqp.Delivery {
+	delivery := amqp.Delivery{
+		Acknowledger: acknowledger,
+		RoutingKey:   message.Subject,
+		Body:         message.Data,
+		MessageId:    message.Header.Get(nats.MsgIdHdr),
+	}
+	if len(message.Header) > 0 {
+		delivery.Headers = amqp.Table{}
+		for key := range message.Header {
+			delivery.Headers[key] = message.Header.Get(key)
+		}
+	}
+	if metadata, err := message.Metadata(); err == nil {
+		delivery.Redelivered = metadata.NumDelivered > 1
+		delivery.DeliveryTag = metadata.Sequence.Stream
+		if delivery.MessageId == "" {
+			delivery.MessageId = strconv.FormatUint(metadata.Sequence.Stream, 10)
+		}
+	}
+	return delivery
+}
+
+// natsAcknowledger settles a single JetStream message.
+type natsAcknowledger struct {
+	consumer *natsConsumer
+	message  *nats.Msg
+	once     sync.Once
+}
+
+func (ack *natsAcknowledger) Ack(tag uint64, multiple bool) error {
+	return ack.settle(ack.message.Ack)
+}
+
+func (ack *natsAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		return ack.settle(ack.message.Nak)
+	}
+	return ack.settle(ack.message.Term)
+}
+
+func (ack *natsAcknowledger) Reject(tag uint64, requeue bool) error {
+	return ack.Nack(tag, false, requeue)
+}
+
+func (ack *natsAcknowledger) settle(reply func(opts ...nats.AckOpt) error) (err error) {
+	ack.once.Do(func() {
+		consumer := ack.consumer
+		consumer.lock.Lock()
+		consumer.unacked--
+		consumer.lock.Unlock()
+		if err = reply(); err != nil {
+			err = errors.Wrap(err, "Couldn't settle stream message")
+		}
+	})
+	return err
+}
@@ -0,0 +1,41 @@
+package worker
+
+import (
+	"github.com/nats-io/nats.go"
+	"testing"
+)
+
+func TestNatsDelivery(t *testing.T) {
+	message := &nats.Msg{
+		Subject: "orders.created",
+		Data:    []byte(`{"event":"order_created"}`),
+		Header:  nats.Header{nats.MsgIdHdr: []string{"order-7"}, "x-event-version": []string{"2"}},
+	}
+	delivery := natsDelivery(message, nil)
+
+	if string(delivery.Body) != `{"event":"order_created"}` || delivery.RoutingKey != "orders.created" {
+		t.Errorf("Unexpected delivery %+v", delivery)
+	}
+	if delivery.MessageId != "order-7" || delivery.Headers["x-event-version"] != "2" {
+		t.Errorf("Unexpected message ID %s or headers %v", delivery.MessageId, delivery.Headers)
+	}
+	if delivery.Redelivered {
+		t.Error("Expected a message without JetStream metadata not to be redelivered")
+	}
+}
+
+func TestNatsAcknowledgerSettlesOnce(t *testing.T) {
+	broker := &NatsBroker{}
+	broker.SetPrefetch(2)
+	consumer := &natsConsumer{broker: broker, unacked: 1}
+	ack := &natsAcknowledger{consumer: consumer, message: &nats.Msg{}}
+
+	// a message that didn't come from a subscription can't be acked
+	if err := ack.Nack(0, false, true); err == nil {
+		t.Error("Expected the nack to fail")
+	}
+	ack.Ack(0, false)
+	if consumer.available() != 2 {
+		t.Errorf("Expected 2 available but got %d", consumer.available())
+	}
+}
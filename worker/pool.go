@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"sync"
+)
+
+// pool is a resizable group of minions reading from the same jobs channel.
+type pool struct {
+	sync.Mutex
+	jobs    chan *Event
+	minions []chan struct{}
+	nextID  int
+}
+
+func newPool(jobs chan *Event, size int) *pool {
+	p := &pool{jobs: jobs}
+	p.resize(size)
+	return p
+}
+
+func (p *pool) size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.minions)
+}
+
+// resize starts or stops minions until there are exactly size of them.
+// A stopped minion finishes the job it is working on before exiting.
+func (p *pool) resize(size int) {
+	p.Lock()
+	defer p.Unlock()
+	for len(p.minions) < size {
+		quit := make(chan struct{})
+		p.minions = append(p.minions, quit)
+		go worker(p.nextID, p.jobs, quit)
+		p.nextID++
+	}
+	for len(p.minions) > size {
+		last := len(p.minions) - 1
+		close(p.minions[last])
+		p.minions = p.minions[:last]
+	}
+}
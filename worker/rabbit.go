@@ -2,6 +2,7 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/streadway/amqp"
@@ -12,34 +13,46 @@ import (
 	"github.com/roeepolegfiverr/gofiverr/errors"
 	"github.com/roeepolegfiverr/gofiverr/logger"
 	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/encryption"
 	"github.com/roeepolegfiverr/gofiverr/statsd"
+	"github.com/roeepolegfiverr/gofiverr/tracing"
 )
 
 type WorkerTask func(*Event) (err error)
 type WorkerTasks struct {
-	Tasks map[string]WorkerTask
+	Tasks      map[string]WorkerTask
+	BatchTasks map[string]*batchTask
 }
 type Event struct {
 	Params          map[string]interface{}
 	Valid           bool
 	Name            string
+	Version         int
 	OriginalMessage amqp.Delivery
+	// Context carries the trace the event was published in, tasks should pass it on.
+	Context context.Context
 }
 type hash map[string]interface{}
 
 var (
 	Tasks      = &WorkerTasks{Tasks: map[string]WorkerTask{}}
 	routingKey string
-	workerName string
 )
 
+// AddTask registers task for key. Tasks are guarded by the worker state lock, so they
+// can be added and removed while the worker is running.
 func (tasks *WorkerTasks) AddTask(key string, task WorkerTask) bool {
 	if tasks == nil {
 		tasks = &WorkerTasks{Tasks: map[string]WorkerTask{}}
 	}
+	state.Lock()
+	defer state.Unlock()
 	if tasks.Tasks == nil {
 		tasks.Tasks = map[string]WorkerTask{}
 	}
+	if _, ok := tasks.BatchTasks[key]; ok {
+		return false
+	}
 	if _, ok := tasks.Tasks[key]; !ok {
 		tasks.Tasks[key] = task
 		return true
@@ -48,13 +61,41 @@ func (tasks *WorkerTasks) AddTask(key string, task WorkerTask) bool {
 }
 
 func (tasks *WorkerTasks) RemoveTask(key string) bool {
+	state.Lock()
+	defer state.Unlock()
 	if _, ok := tasks.Tasks[key]; ok {
 		delete(tasks.Tasks, key)
 		return true
 	}
+	if _, ok := tasks.BatchTasks[key]; ok {
+		delete(tasks.BatchTasks, key)
+		return true
+	}
 	return false
 }
 
+// findTask returns the task registered for an event name.
+func findTask(name string) (WorkerTask, bool) {
+	state.Lock()
+	defer state.Unlock()
+	task, ok := Tasks.Tasks[name]
+	return task, ok
+}
+
+// findBatchTask returns the batch task registered for an event name.
+func findBatchTask(name string) (*batchTask, bool) {
+	state.Lock()
+	defer state.Unlock()
+	batch, ok := Tasks.BatchTasks[name]
+	return batch, ok
+}
+
+func hasTasks() bool {
+	state.Lock()
+	defer state.Unlock()
+	return len(Tasks.Tasks) > 0 || len(Tasks.BatchTasks) > 0
+}
+
 func (event *Event) GetString(key string) (string, error) {
 	if val, ok := event.Params[key]; ok {
 		switch vv := val.(type) {
@@ -108,61 +149,110 @@ func (event *Event) GetBool(key string) (bool, error) {
 }
 
 // Consume is the main worker method. It connect to a given queue and infinitely reads and handle messages.
+// listener, if not nil, gets the received events before they are worked on. Consume
+// doesn't wait for it, events it isn't ready for are dropped, so give it a buffer.
+// New code should use AddHooks instead.
 func Consume(queueName string, pworkerName string, proutingKey string, workersInPool int, listener chan *Event) {
 	routingKey = proutingKey
-	workerName = pworkerName
 	if queueName == "" {
 		logger.ErrorLog(errors.New("Worker queue name is empty"))
 		return
 	}
-	if len(Tasks.Tasks) == 0 {
+	if !hasTasks() {
 		logger.ErrorLog(errors.New("Worker Tasks are empty, nothing to work on"))
 		return
 	}
+	jobs := make(chan *Event)
+	minions := newPool(jobs, workersInPool)
+	state.start(pworkerName, queueName, minions)
+	startBatchers()
+	state.startAutoscaler()
 	// TODO - need to be tested
 	//infinite loop for reconnecting after channel closed or some other failure
 	for {
-		var channel *amqp.Channel
-		channel = connectors.Clients.Rabbit()
+		state.waitWhilePaused()
+		b := currentBroker()
 		host, err := os.Hostname()
 		consumerName := fmt.Sprintf("%s-%s-go-consumer", host, queueName)
-		messages, err := channel.Consume(queueName, consumerName, false, false, false, false, nil)
+		messages, err := b.Consume(queueName, consumerName)
 
 		if err != nil {
-			fmt.Printf("Error consuming rabbit %s", err)
+			fmt.Printf("Error consuming %s", err)
 			logger.ErrorLog(errors.Wrap(err, err.Error()))
+			state.setConnected(false)
 			return
 		}
-		jobs := make(chan *Event)
-		for w := 0; w < workersInPool; w++ {
-			go worker(w, jobs)
-		}
-		fmt.Printf("Worker starting on queue %s with %d minions\nWaiting for some messages to work on\n", queueName, workersInPool)
+		state.setConsumer(b, consumerName)
+		fmt.Printf("Worker starting on queue %s with %d minions\nWaiting for some messages to work on\n", queueName, minions.size())
 		for message := range messages {
-			//fmt.Printf("got message with body:%s \n", message.Body)
-			eventMessage, err := parseMessage(message)
-			if err != nil {
-				logger.ErrorLog(errors.Wrap(err, err.Error()))
-			}
-			if listener != nil {
-				listener <- eventMessage
-			}
-
-			jobs <- eventMessage
+			receive(message, listener, jobs)
+		}
+		state.setConnected(false)
+		if state.isPaused() {
+			fmt.Printf("Worker paused on queue %s\n", queueName)
+			continue
 		}
 		logger.ErrorLog(errors.New("Consuming failed, trying to reconnect"))
 	}
 }
 
-func worker(id int, jobs <-chan *Event) {
-	for job := range jobs {
+// receive hands a message on to its batch or to the minions, or back to the queue if
+// the worker is paused.
+func receive(message amqp.Delivery, listener chan *Event, jobs chan<- *Event) {
+	//fmt.Printf("got message with body:%s \n", message.Body)
+	eventMessage, err := parseMessage(message)
+	if err != nil {
+		logger.ErrorLog(errors.Wrap(err, err.Error()))
+	}
+	// messages the broker pushed before we paused go back to the queue
+	if state.isPaused() {
+		message.Nack(false, true)
+		return
+	}
+	// recorded and reported once, when it is worked on rather than each time it is delivered
+	recordReceived(eventMessage)
+	notifyReceived(eventMessage)
+	notifyListener(listener, eventMessage)
+
+	// counted until its job starts, Drain waits for it
+	state.queueJob()
+	if batch, ok := findBatchTask(eventMessage.Name); ok && eventMessage.Valid {
+		// upcast and validated once, a failure never reaches the batch nor a minion
+		if err := prepareEvent(eventMessage); err != nil {
+			rejectBatchEvent(eventMessage, err)
+			return
+		}
+		batch.events <- eventMessage
+		return
+	}
+	jobs <- eventMessage
+}
+
+func worker(id int, jobs <-chan *Event, quit <-chan struct{}) {
+	for {
+		var job *Event
+		select {
+		case <-quit:
+			return
+		case job = <-jobs:
+		}
 		//fmt.Printf("%d minion got some work\n", id)
 		//wrap the main process function so I can pass it to the wrappers
 		fn := func() error {
 			return process(job)
 		}
+		jobID := state.startQueuedJob(id, job)
+		ctx, span := tracing.StartConsumeSpan(job.Context, state.queue(), job.Name)
+		job.Context = ctx
+		notifyStarted(job)
+		start := time.Now()
 		// invoke the process method with middlewares wrappers.
-		ackMessage(statsd.StatsDWrapper(job.Name, logger.RecoverAndLogWrapper(fn)), job.OriginalMessage)
+		err := ackMessage(statsd.StatsDWrapper(job.Name, logger.RecoverAndLogWrapper(fn)), job.OriginalMessage)
+		elapsed := time.Since(start)
+		state.finishJob(jobID, job.Name, err, elapsed)
+		tracing.EndSpan(span, err)
+		notifyDone(job, elapsed, err)
+		recordResult(err)
 	}
 }
 
@@ -175,20 +265,25 @@ func process(event *Event) error {
 	if event.Name == "" {
 		return errors.New("Event name is empty")
 	}
+	if err := prepareEvent(event); err != nil {
+		return err
+	}
 	//check if there is valid task for the event
-	if task, found := Tasks.Tasks[event.Name]; found {
+	if task, found := findTask(event.Name); found {
 		return task(event)
 	}
 	return errors.Newf("Couldn't find task for event %+v", event)
 
 }
 
-func ackMessage(fn func() error, message amqp.Delivery) {
+func ackMessage(fn func() error, message amqp.Delivery) error {
 	defer message.Ack(false)
-	if err := fn(); err != nil {
+	err := fn()
+	if err != nil {
 		fmt.Println("Got an error, falling back")
 		sendToFailedQueue(message, err)
 	}
+	return err
 }
 
 func parseMessage(message amqp.Delivery) (*Event, error) {
@@ -196,14 +291,25 @@ func parseMessage(message amqp.Delivery) (*Event, error) {
 	err := json.Unmarshal(message.Body, &params)
 	if err != nil {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
+	} else if encryption.IsEncrypted(params) {
+		// keep the envelope if we can't open it, at least the event name is in clear
+		opened, openErr := openParams(params)
+		if openErr != nil {
+			err = openErr
+			logger.ErrorLog(errors.Wrap(err, err.Error()))
+		} else {
+			params = opened
+		}
 	}
 
 	var eventName string
 	if val, ok := params["event"]; ok {
-		eventName = val.(string)
+		if eventName, ok = val.(string); !ok {
+			err = errors.Newf("Event name %v is not a string", val)
+		}
 	}
 
-	if eventName == "" {
+	if eventName == "" && err == nil {
 		err = errors.New("Event name is empty")
 	}
 
@@ -211,50 +317,82 @@ func parseMessage(message amqp.Delivery) (*Event, error) {
 		Params:          params,
 		Valid:           err == nil && eventName != "",
 		Name:            eventName,
+		Version:         messageVersion(message, params),
 		OriginalMessage: message,
+		Context:         tracing.Extract(context.Background(), message.Headers),
 	}
 	return event, err
 }
 
 func sendToFailedQueue(message amqp.Delivery, err error) {
-	m_err := err.(errors.FiverrError)
-	eventMessage, _ := parseMessage(message)
-	jsonMessage := sanitizeMessage(eventMessage.Params)
+	m_err, ok := err.(errors.FiverrError)
+	if !ok {
+		m_err = errors.Wrap(err, err.Error())
+	}
+	// don't decrypt, encrypted events are kept encrypted in the failed queue too
+	var params hash
+	json.Unmarshal(message.Body, &params)
+	jsonMessage := sanitizeMessage(params)
 	session, err := connectors.Clients.NamedMongo("failed_queue")
 	if err != nil {
 		logger.ErrorLog(errors.Wrap(err, err.Error()))
 		return
 	}
 	defer session.Close()
+	eventName, _ := params["event"].(string)
+	fingerprint := errorFingerprint(eventName, m_err.GetMessage())
+	now := time.Now()
 	doc := hash{
 		"message":         jsonMessage,
 		"routing_key":     routingKey,
+		"event":           eventName,
+		"fingerprint":     fingerprint,
 		"error_message":   m_err.GetMessage(),
 		"error_backtrace": m_err.Error(),
-		"created_at":      time.Now(),
+		"created_at":      now,
 	}
-	collection := session.DB("").C(
-		fmt.Sprintf("%s_failed_queue", workerName))
+	collection := session.DB("").C(failedQueueName())
+	ensureFailedQueueIndexes(collection, createFailedQueueIndexes)
 	collection.Insert(doc)
 
+	counts := session.DB("").C(failedCountsName())
+	ensureFailedQueueIndexes(counts, createFailedCountsIndexes)
+	if err := countFailure(counts, eventName, fingerprint, m_err.GetMessage(), now); err != nil {
+		logger.ErrorLog(errors.Wrap(err, "Couldn't count the failure"))
+	}
+
 }
 
 func sanitizeMessage(message hash) hash {
 	fixedMessage := hash{}
 	for k, v := range message {
-		k = fixMongoKeys(k)
-		if val, ok := v.(map[string]interface{}); ok {
-			fixedMessage[k] = sanitizeMessage(val)
-		} else if val, ok := v.(string); ok {
-			if !utf8.ValidString(val) {
-				v = sanitizeString(val)
-			}
+		if isRedacted(k) {
+			fixedMessage[fixMongoKeys(k)] = redactedValue
+			continue
 		}
-		fixedMessage[k] = v
+		fixedMessage[fixMongoKeys(k)] = sanitizeValue(v)
 	}
 	return fixedMessage
 }
 
+func sanitizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return sanitizeMessage(val)
+	case []interface{}:
+		fixedValues := make([]interface{}, len(val))
+		for i, item := range val {
+			fixedValues[i] = sanitizeValue(item)
+		}
+		return fixedValues
+	case string:
+		if !utf8.ValidString(val) {
+			return sanitizeString(val)
+		}
+	}
+	return v
+}
+
 func fixMongoKeys(key string) string {
 	return strings.Replace(key, ".", "_", -1)
 }
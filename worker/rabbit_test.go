@@ -60,16 +60,20 @@ func publishMessages(n int) {
 func TestStress(t *testing.T) {
 	n := 10
 	publishMessages(n)
-	listener := make(chan bool)
+	done := make(chan error, n)
+	AddHooks(Hooks{
+		OnAcked: func(event *Event, elapsed time.Duration, err error) {
+			done <- err
+		},
+	})
 	start := time.Now()
 	queueName := syslib.Config.Get("worker_queue", "")
 	routingKey := syslib.Config.Get("routing_key", "")
 	workerName := syslib.Config.Get("worker_name", "")
-	go Consume(queueName, workerName, routingKey,1, listener)
+	go Consume(queueName, workerName, routingKey, 1, nil)
 
 	for i := 0; i < n; i++ {
-		fmt.Printf("Got new message %d with %v\n", i, <-listener)
-		<-listener
+		fmt.Printf("Got new message %d with %v\n", i, <-done)
 	}
 	t.Logf("this test took :%s", time.Since(start))
 	if 1 != 1 {
@@ -0,0 +1,441 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"github.com/streadway/amqp"
+	"strings"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/connectors"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// RedisStreamBroker consumes a Redis stream, named after the queue, through a consumer
+// group. Producers add events with
+//
+//	XADD <queue> * body <json> [headers <json>] [routing_key <key>]
+//
+// or with the event params as plain fields, whose values are all strings, use body
+// for params of other types. Messages nacked with requeue are delivered again right
+// away, messages that stay unacked for ClaimAfter because their consumer died are
+// claimed by another one. Either way they are delivered with Redelivered set.
+type RedisStreamBroker struct {
+	// Connection is the name of the redis connection in the config.
+	Connection string
+	// Group is the consumer group, defaults to the queue name.
+	Group string
+	// Block is how long a read waits for new messages. Defaults to 2 seconds.
+	Block time.Duration
+	// ClaimAfter is how long a message may stay unacked before it is delivered again.
+	// Defaults to 5 minutes, it should be longer than the slowest task.
+	ClaimAfter time.Duration
+
+	lock      sync.Mutex
+	prefetch  int
+	consumers map[string]*streamConsumer
+}
+
+type streamConsumer struct {
+	broker     *RedisStreamBroker
+	stream     string
+	group      string
+	name       string
+	conn       *redis.Client
+	deliveries chan amqp.Delivery
+	stop       chan struct{}
+	lock       sync.Mutex
+	unacked    int
+	// requeued are the entries nacked with requeue, waiting to be delivered again.
+	requeued []string
+}
+
+type streamEntry struct {
+	id     string
+	fields []string
+}
+
+const (
+	defaultStreamReadCount = 10
+	// pendingPageSize is how many pending entries are inspected at once.
+	pendingPageSize = 100
+)
+
+func (b *RedisStreamBroker) Consume(queueName, consumerName string) (<-chan amqp.Delivery, error) {
+	group := b.Group
+	if group == "" {
+		group = queueName
+	}
+	conn, err := connectors.Clients.NewRedisConnection(b.Connection, b.block())
+	if err != nil {
+		return nil, err
+	}
+	reply := conn.Cmd("XGROUP", "CREATE", queueName, group, "$", "MKSTREAM")
+	if reply.Err != nil && !strings.HasPrefix(reply.Err.Error(), "BUSYGROUP") {
+		conn.Close()
+		return nil, errors.Wrap(reply.Err, fmt.Sprintf("Couldn't create consumer group %s", group))
+	}
+
+	consumer := &streamConsumer{
+		broker:     b,
+		stream:     queueName,
+		group:      group,
+		name:       consumerName,
+		conn:       conn,
+		deliveries: make(chan amqp.Delivery),
+		stop:       make(chan struct{}),
+	}
+	b.lock.Lock()
+	if b.consumers == nil {
+		b.consumers = map[string]*streamConsumer{}
+	}
+	if old, ok := b.consumers[consumerName]; ok {
+		old.cancel()
+	}
+	b.consumers[consumerName] = consumer
+	b.lock.Unlock()
+
+	go consumer.run()
+	return consumer.deliveries, nil
+}
+
+func (b *RedisStreamBroker) Cancel(consumerName string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if consumer, ok := b.consumers[consumerName]; ok {
+		consumer.cancel()
+		delete(b.consumers, consumerName)
+	}
+	return nil
+}
+
+func (b *RedisStreamBroker) SetPrefetch(prefetch int) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prefetch = prefetch
+	return nil
+}
+
+// QueueDepth returns the group lag, the entries that were never delivered to it.
+// It needs redis 7.
+func (b *RedisStreamBroker) QueueDepth(queueName string) (int, error) {
+	group := b.Group
+	if group == "" {
+		group = queueName
+	}
+	var depth int
+	// the consumers own connections block on reads, everything else goes through the pool
+	err := connectors.Clients.WithNamedRedis(b.Connection, func(conn connectors.RedisConn) error {
+		reply := conn.Cmd("XINFO", "GROUPS", queueName)
+		if reply.Err != nil {
+			return reply.Err
+		}
+		for _, info := range reply.Elems {
+			fields := replyFields(info)
+			if fields["name"] == nil || replyString(fields["name"]) != group {
+				continue
+			}
+			lag, ok := fields["lag"]
+			if !ok || lag.Type != redis.IntegerReply {
+				return errors.Newf("Redis doesn't know the lag of group %s", group)
+			}
+			depth, _ = lag.Int()
+			return nil
+		}
+		return errors.Newf("Couldn't find consumer group %s", group)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Couldn't inspect stream")
+	}
+	return depth, nil
+}
+
+func (b *RedisStreamBroker) currentPrefetch() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.prefetch
+}
+
+func (b *RedisStreamBroker) block() time.Duration {
+	if b.Block <= 0 {
+		return 2 * time.Second
+	}
+	return b.Block
+}
+
+func (b *RedisStreamBroker) claimAfter() time.Duration {
+	if b.ClaimAfter <= 0 {
+		return 5 * time.Minute
+	}
+	return b.ClaimAfter
+}
+
+func (consumer *streamConsumer) cancel() {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	select {
+	case <-consumer.stop:
+	default:
+		close(consumer.stop)
+	}
+}
+
+func (consumer *streamConsumer) stopped() bool {
+	select {
+	case <-consumer.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (consumer *streamConsumer) run() {
+	defer close(consumer.deliveries)
+	defer consumer.conn.Close()
+
+	var lastClaim time.Time
+	for !consumer.stopped() {
+		if time.Since(lastClaim) > consumer.broker.claimAfter()/2 {
+			lastClaim = time.Now()
+			if err := consumer.claimStale(); err != nil {
+				logger.ErrorLog(errors.Wrap(err, "Couldn't claim pending stream messages"))
+				return
+			}
+		}
+
+		if err := consumer.redeliverRequeued(); err != nil {
+			logger.ErrorLog(errors.Wrap(err, "Couldn't deliver requeued stream messages"))
+			return
+		}
+
+		count := consumer.available()
+		if count <= 0 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		reply := consumer.conn.Cmd("XREADGROUP", "GROUP", consumer.group, consumer.name,
+			"COUNT", count, "BLOCK", int64(consumer.broker.block()/time.Millisecond),
+			"STREAMS", consumer.stream, ">")
+		if reply.Err != nil {
+			logger.ErrorLog(errors.Wrap(reply.Err, "Couldn't read from stream"))
+			return
+		}
+		// XREADGROUP answers [[stream, [entries]]], or nil when the block timed out
+		for _, stream := range reply.Elems {
+			if len(stream.Elems) < 2 {
+				continue
+			}
+			entries, _ := parseEntries(stream.Elems[1])
+			for _, entry := range entries {
+				if !consumer.deliver(entry, false) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// claimStale takes over the messages of the group that were delivered but not acked
+// for too long and delivers them again, a page of pending entries at a time.
+func (consumer *streamConsumer) claimStale() error {
+	minIdle := int64(consumer.broker.claimAfter() / time.Millisecond)
+	start := "-"
+	for !consumer.stopped() {
+		// each pending entry is [id, consumer, idle ms, delivery count]
+		reply := consumer.conn.Cmd("XPENDING", consumer.stream, consumer.group,
+			"IDLE", minIdle, start, "+", pendingPageSize)
+		if reply.Err != nil {
+			return reply.Err
+		}
+		stale := []interface{}{}
+		for _, pending := range reply.Elems {
+			if len(pending.Elems) > 0 {
+				stale = append(stale, replyString(pending.Elems[0]))
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		if err := consumer.claim(minIdle, stale); err != nil {
+			return err
+		}
+		if len(reply.Elems) < pendingPageSize {
+			return nil
+		}
+		start = "(" + stale[len(stale)-1].(string)
+	}
+	return nil
+}
+
+// redeliverRequeued claims the entries nacked with requeue back and delivers them again.
+func (consumer *streamConsumer) redeliverRequeued() error {
+	consumer.lock.Lock()
+	requeued := consumer.requeued
+	consumer.requeued = nil
+	consumer.lock.Unlock()
+	if len(requeued) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(requeued))
+	for i, id := range requeued {
+		ids[i] = id
+	}
+	return consumer.claim(0, ids)
+}
+
+// claim takes the entries over for this consumer and delivers them again. Entries
+// another consumer claimed or acked in the meantime are left out by XCLAIM, entries
+// deleted from the stream are acked so they leave the pending list.
+func (consumer *streamConsumer) claim(minIdle int64, ids []interface{}) error {
+	args := append([]interface{}{consumer.stream, consumer.group, consumer.name, minIdle}, ids...)
+	reply := consumer.conn.Cmd("XCLAIM", args...)
+	if reply.Err != nil {
+		return reply.Err
+	}
+	entries, deleted := parseEntries(reply)
+	if len(deleted) > 0 {
+		args := append([]interface{}{consumer.stream, consumer.group}, deleted...)
+		if reply := consumer.conn.Cmd("XACK", args...); reply.Err != nil {
+			return reply.Err
+		}
+	}
+	for _, entry := range entries {
+		if !consumer.deliver(entry, true) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// available is how many more messages may be read without going over the prefetch.
+func (consumer *streamConsumer) available() int {
+	prefetch := consumer.broker.currentPrefetch()
+	if prefetch <= 0 {
+		return defaultStreamReadCount
+	}
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	return prefetch - consumer.unacked
+}
+
+func (consumer *streamConsumer) deliver(entry streamEntry, redelivered bool) bool {
+	delivery := streamDelivery(entry, &streamAcknowledger{consumer: consumer, id: entry.id}, redelivered)
+	delivery.ConsumerTag = consumer.name
+	consumer.lock.Lock()
+	consumer.unacked++
+	consumer.lock.Unlock()
+	select {
+	case consumer.deliveries <- delivery:
+		return true
+	case <-consumer.stop:
+		return false
+	}
+}
+
+// streamDelivery turns a stream entry into the delivery the worker expects. The body
+// field is the message, entries without one are taken as the event params.
+func streamDelivery(entry streamEntry, acknowledger amqp.Acknowledger, redelivered bool) amqp.Delivery {
+	delivery := amqp.Delivery{
+		Acknowledger: acknowledger,
+		MessageId:    entry.id,
+		Redelivered:  redelivered,
+	}
+	params := map[string]interface{}{}
+	for i := 0; i+1 < len(entry.fields); i += 2 {
+		key, value := entry.fields[i], entry.fields[i+1]
+		switch key {
+		case "body":
+			delivery.Body = []byte(value)
+		case "routing_key":
+			delivery.RoutingKey = value
+		case "headers":
+			var headers map[string]interface{}
+			if err := json.Unmarshal([]byte(value), &headers); err == nil {
+				delivery.Headers = amqp.Table(headers)
+			}
+		default:
+			params[key] = value
+		}
+	}
+	if delivery.Body == nil {
+		delivery.Body, _ = json.Marshal(params)
+	}
+	return delivery
+}
+
+// streamAcknowledger acks a single stream entry. Nacks with requeue leave the entry
+// pending and hand it back to the consumer, which delivers it again.
+type streamAcknowledger struct {
+	consumer *streamConsumer
+	id       string
+	once     sync.Once
+}
+
+func (ack *streamAcknowledger) Ack(tag uint64, multiple bool) error {
+	return ack.settle(true)
+}
+
+func (ack *streamAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ack.settle(!requeue)
+}
+
+func (ack *streamAcknowledger) Reject(tag uint64, requeue bool) error {
+	return ack.settle(!requeue)
+}
+
+func (ack *streamAcknowledger) settle(remove bool) (err error) {
+	ack.once.Do(func() {
+		consumer := ack.consumer
+		consumer.lock.Lock()
+		consumer.unacked--
+		if !remove {
+			consumer.requeued = append(consumer.requeued, ack.id)
+		}
+		consumer.lock.Unlock()
+		if !remove {
+			return
+		}
+		err = connectors.Clients.WithNamedRedis(consumer.broker.Connection, func(conn connectors.RedisConn) error {
+			return conn.Cmd("XACK", consumer.stream, consumer.group, ack.id).Err
+		})
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Couldn't ack stream message %s", ack.id))
+		}
+	})
+	return err
+}
+
+// parseEntries reads a list of [id, [field, value, ...]] stream entries. Entries that
+// were deleted while pending come back without fields, their ids are returned apart.
+func parseEntries(reply *redis.Reply) (entries []streamEntry, deleted []interface{}) {
+	entries = []streamEntry{}
+	for _, elem := range reply.Elems {
+		if len(elem.Elems) == 0 {
+			continue
+		}
+		id := replyString(elem.Elems[0])
+		if len(elem.Elems) < 2 || elem.Elems[1].Type != redis.MultiReply {
+			deleted = append(deleted, id)
+			continue
+		}
+		fields, _ := elem.Elems[1].List()
+		entries = append(entries, streamEntry{id: id, fields: fields})
+	}
+	return entries, deleted
+}
+
+// replyFields reads a flat [name, value, ...] reply into a map.
+func replyFields(reply *redis.Reply) map[string]*redis.Reply {
+	fields := map[string]*redis.Reply{}
+	for i := 0; i+1 < len(reply.Elems); i += 2 {
+		fields[replyString(reply.Elems[i])] = reply.Elems[i+1]
+	}
+	return fields
+}
+
+func replyString(reply *redis.Reply) string {
+	s, _ := reply.Str()
+	return s
+}
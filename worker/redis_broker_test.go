@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"testing"
+)
+
+func TestStreamDeliveryReadsBodyAndHeaders(t *testing.T) {
+	entry := streamEntry{id: "1-0", fields: []string{
+		"body", `{"event":"order_created"}`,
+		"headers", `{"x-event-version":2}`,
+		"routing_key", "orders.created",
+	}}
+	delivery := streamDelivery(entry, nil, true)
+
+	if string(delivery.Body) != `{"event":"order_created"}` {
+		t.Errorf("Unexpected body %s", delivery.Body)
+	}
+	if delivery.RoutingKey != "orders.created" || delivery.MessageId != "1-0" || !delivery.Redelivered {
+		t.Errorf("Unexpected delivery %+v", delivery)
+	}
+	if delivery.Headers["x-event-version"] != float64(2) {
+		t.Errorf("Unexpected headers %v", delivery.Headers)
+	}
+}
+
+func TestStreamDeliveryWithoutBodyUsesFields(t *testing.T) {
+	delivery := streamDelivery(streamEntry{id: "1-0", fields: []string{
+		"event", "order_created", "id", "5", "paid", "true", "note", "5 gigs",
+	}}, nil, false)
+
+	event, err := parseMessage(delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != "order_created" {
+		t.Errorf("Unexpected event %s", event.Name)
+	}
+	// plain fields are strings, whatever they look like
+	for key, expected := range map[string]string{"id": "5", "paid": "true", "note": "5 gigs"} {
+		if value, err := event.GetString(key); err != nil || value != expected {
+			t.Errorf("Expected %s to be the string %s got %v, %v", key, expected, value, err)
+		}
+	}
+}
+
+func TestStreamAcknowledgerSettlesOnce(t *testing.T) {
+	broker := &RedisStreamBroker{}
+	broker.SetPrefetch(2)
+	consumer := &streamConsumer{broker: broker, unacked: 1}
+	ack := &streamAcknowledger{consumer: consumer, id: "1-0"}
+
+	// a requeued message stays pending, it goes back to the consumer rather than redis
+	if err := ack.Nack(0, false, true); err != nil {
+		t.Fatal(err)
+	}
+	ack.Nack(0, false, true)
+	if consumer.unacked != 0 {
+		t.Errorf("Expected no unacked messages but got %d", consumer.unacked)
+	}
+	if len(consumer.requeued) != 1 || consumer.requeued[0] != "1-0" {
+		t.Errorf("Expected the message to be requeued once got %v", consumer.requeued)
+	}
+	if consumer.available() != 2 {
+		t.Errorf("Expected 2 available but got %d", consumer.available())
+	}
+}
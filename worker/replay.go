@@ -0,0 +1,328 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// RecordedEvent is a single line of a recording file.
+type RecordedEvent struct {
+	Exchange   string                   `json:"exchange"`
+	RoutingKey string                   `json:"routing_key"`
+	Headers    map[string]RecordedValue `json:"headers"`
+	Body       []byte                   `json:"body"`
+	RecordedAt time.Time                `json:"recorded_at"`
+}
+
+// RecordedValue is a header value with its AMQP type, JSON alone would turn every
+// number into a float64 and every timestamp into a string.
+type RecordedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func recordValue(value interface{}) (RecordedValue, error) {
+	var typeName string
+	switch v := value.(type) {
+	case nil:
+		typeName = "null"
+	case string:
+		typeName = "string"
+	case bool:
+		typeName = "bool"
+	case int:
+		typeName = "int"
+	case int8:
+		typeName = "int8"
+	case int16:
+		typeName = "int16"
+	case int32:
+		typeName = "int32"
+	case int64:
+		typeName = "int64"
+	case float32:
+		typeName = "float32"
+	case float64:
+		typeName = "float64"
+	case []byte:
+		typeName = "bytes"
+	case time.Time:
+		typeName = "timestamp"
+	case amqp.Decimal:
+		typeName = "decimal"
+	case amqp.Table:
+		table, err := recordHeaders(v)
+		if err != nil {
+			return RecordedValue{}, err
+		}
+		value, typeName = table, "table"
+	case []interface{}:
+		array := make([]RecordedValue, len(v))
+		for i, item := range v {
+			recorded, err := recordValue(item)
+			if err != nil {
+				return RecordedValue{}, err
+			}
+			array[i] = recorded
+		}
+		value, typeName = array, "array"
+	default:
+		return RecordedValue{}, errors.Newf("Can't record header value of type %T", value)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return RecordedValue{}, errors.Wrap(err, "Couldn't record header value")
+	}
+	return RecordedValue{Type: typeName, Value: encoded}, nil
+}
+
+func recordHeaders(headers amqp.Table) (map[string]RecordedValue, error) {
+	recorded := map[string]RecordedValue{}
+	for key, value := range headers {
+		encoded, err := recordValue(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Couldn't record header %s", key)
+		}
+		recorded[key] = encoded
+	}
+	return recorded, nil
+}
+
+// recordedTypes makes an empty value to decode each recorded header type into.
+var recordedTypes = map[string]func() interface{}{
+	"string":    func() interface{} { return new(string) },
+	"bool":      func() interface{} { return new(bool) },
+	"int":       func() interface{} { return new(int) },
+	"int8":      func() interface{} { return new(int8) },
+	"int16":     func() interface{} { return new(int16) },
+	"int32":     func() interface{} { return new(int32) },
+	"int64":     func() interface{} { return new(int64) },
+	"float32":   func() interface{} { return new(float32) },
+	"float64":   func() interface{} { return new(float64) },
+	"bytes":     func() interface{} { return new([]byte) },
+	"timestamp": func() interface{} { return new(time.Time) },
+	"decimal":   func() interface{} { return new(amqp.Decimal) },
+}
+
+// value decodes the header value with the type it was recorded with.
+func (recorded RecordedValue) value() (interface{}, error) {
+	var err error
+	var value interface{}
+	switch recorded.Type {
+	case "null":
+	case "table":
+		var table map[string]RecordedValue
+		if err = json.Unmarshal(recorded.Value, &table); err == nil {
+			value, err = replayHeaders(table)
+		}
+	case "array":
+		var array []RecordedValue
+		if err = json.Unmarshal(recorded.Value, &array); err == nil {
+			values := make([]interface{}, len(array))
+			for i := 0; i < len(array) && err == nil; i++ {
+				values[i], err = array[i].value()
+			}
+			value = values
+		}
+	default:
+		newValue, ok := recordedTypes[recorded.Type]
+		if !ok {
+			return nil, errors.Newf("Unknown recorded header type %s", recorded.Type)
+		}
+		decoded := newValue()
+		if err = json.Unmarshal(recorded.Value, decoded); err == nil {
+			value = reflect.ValueOf(decoded).Elem().Interface()
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't read recorded %s header", recorded.Type))
+	}
+	return value, nil
+}
+
+func replayHeaders(recorded map[string]RecordedValue) (amqp.Table, error) {
+	if recorded == nil {
+		return nil, nil
+	}
+	headers := amqp.Table{}
+	for key, value := range recorded {
+		decoded, err := value.value()
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
+
+// Recorder writes events to a JSONL file so they can be replayed locally later.
+type Recorder struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewRecorder opens path for recording, appending to it if it already exists.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't open recording file")
+	}
+	return &Recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Record appends the message the event came from to the recording.
+func (recorder *Recorder) Record(event *Event) error {
+	message := event.OriginalMessage
+	headers, err := recordHeaders(message.Headers)
+	if err != nil {
+		return err
+	}
+	recorded := RecordedEvent{
+		Exchange:   message.Exchange,
+		RoutingKey: message.RoutingKey,
+		Headers:    headers,
+		Body:       message.Body,
+		RecordedAt: time.Now(),
+	}
+	recorder.Lock()
+	defer recorder.Unlock()
+	if err := recorder.encoder.Encode(recorded); err != nil {
+		return errors.Wrap(err, "Couldn't record event")
+	}
+	return nil
+}
+
+var (
+	recordersLock sync.RWMutex
+	recorders     []*Recorder
+)
+
+// AddRecorder records every event the worker receives. Unlike hooks, recording is done
+// by Consume itself before the event is worked on, so none is lost under load, at the
+// cost of a file write per event.
+func AddRecorder(recorder *Recorder) {
+	recordersLock.Lock()
+	defer recordersLock.Unlock()
+	recorders = append(recorders, recorder)
+}
+
+// RemoveRecorder stops recording to recorder, e.g. before closing it.
+func RemoveRecorder(recorder *Recorder) {
+	recordersLock.Lock()
+	defer recordersLock.Unlock()
+	for i, added := range recorders {
+		if added == recorder {
+			recorders = append(recorders[:i:i], recorders[i+1:]...)
+			return
+		}
+	}
+}
+
+func recordReceived(event *Event) {
+	recordersLock.RLock()
+	defer recordersLock.RUnlock()
+	for _, recorder := range recorders {
+		if err := recorder.Record(event); err != nil {
+			logger.ErrorLog(errors.Wrap(err, err.Error()))
+		}
+	}
+}
+
+// Close closes the recording file.
+func (recorder *Recorder) Close() error {
+	recorder.Lock()
+	defer recorder.Unlock()
+	return recorder.file.Close()
+}
+
+// ReplayResult is the outcome of replaying a single recorded event.
+type ReplayResult struct {
+	Line     int
+	Event    string
+	Duration time.Duration
+	Err      error
+}
+
+// String formats the result for a report.
+func (result ReplayResult) String() string {
+	if result.Err != nil {
+		return fmt.Sprintf("line %d %s failed after %s: %s", result.Line, result.Event, result.Duration, errorMessage(result.Err))
+	}
+	return fmt.Sprintf("line %d %s succeeded after %s", result.Line, result.Event, result.Duration)
+}
+
+// Replay feeds every event of a recording through the registered Tasks, without
+// RabbitMQ, the failed queue or acks, and reports what happened to each one.
+func Replay(path string) ([]ReplayResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't open recording file")
+	}
+	defer file.Close()
+
+	results := []ReplayResult{}
+	scanner := bufio.NewScanner(file)
+	// bodies can be big, allow lines up to 16MB
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var recorded RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			results = append(results, ReplayResult{Line: line, Err: errors.Wrapf(err, "Couldn't read line %d", line)})
+			continue
+		}
+		results = append(results, replayEvent(line, recorded))
+	}
+	if err := scanner.Err(); err != nil {
+		return results, errors.Wrap(err, "Couldn't read recording file")
+	}
+	return results, nil
+}
+
+func replayEvent(line int, recorded RecordedEvent) (result ReplayResult) {
+	result = ReplayResult{Line: line}
+	start := time.Now()
+	// a bad line fails on its own, it doesn't stop the replay
+	defer func() {
+		if r := recover(); r != nil {
+			result.Err = errors.Newf("Task panicked: %v", r)
+		}
+		result.Duration = time.Since(start)
+	}()
+
+	headers, err := replayHeaders(recorded.Headers)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	message := amqp.Delivery{
+		Exchange:   recorded.Exchange,
+		RoutingKey: recorded.RoutingKey,
+		Headers:    headers,
+		Body:       recorded.Body,
+	}
+	event, _ := parseMessage(message)
+	result.Event = event.Name
+
+	if batch, ok := findBatchTask(event.Name); ok && event.Valid {
+		if result.Err = prepareEvent(event); result.Err == nil {
+			result.Err = runBatch(batch.task, []*Event{event})[0]
+		}
+		return result
+	}
+	result.Err = process(event)
+	return result
+}
@@ -0,0 +1,174 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/streadway/amqp"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	Tasks.AddTask("replay_ok", func(event *Event) error { return nil })
+	Tasks.AddTask("replay_fail", func(event *Event) error {
+		if name, _ := event.GetString("name"); name != "" {
+			return errors.New("no " + name + " allowed")
+		}
+		return nil
+	})
+	defer Tasks.RemoveTask("replay_ok")
+	defer Tasks.RemoveTask("replay_fail")
+
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"event": "replay_ok"}`,
+		`{"event": "replay_fail", "name": "bob"}`,
+		`not json`,
+		`{"event": 5}`,
+		`{"event": "replay_ok"}`,
+	} {
+		event, _ := parseMessage(amqp.Delivery{
+			RoutingKey: "fiverr.events.test",
+			Headers:    amqp.Table{VersionHeader: "1"},
+			Body:       []byte(body),
+		})
+		if err := recorder.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.Close()
+
+	results, err := Replay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("Expected 5 results got %d", len(results))
+	}
+	if results[0].Event != "replay_ok" || results[0].Err != nil {
+		t.Errorf("Expected first event to succeed got %s", results[0])
+	}
+	if results[1].Event != "replay_fail" || results[1].Err == nil || results[1].Err.Error() != "no bob allowed" {
+		t.Errorf("Expected second event to fail got %s", results[1])
+	}
+	if results[2].Err == nil {
+		t.Errorf("Expected invalid event to fail got %s", results[2])
+	}
+	if results[3].Err == nil {
+		t.Errorf("Expected an event name that isn't a string to fail got %s", results[3])
+	}
+	if results[4].Event != "replay_ok" || results[4].Err != nil {
+		t.Errorf("Expected the replay to go on after a bad line got %s", results[4])
+	}
+}
+
+func TestRecordedHeadersKeepTypes(t *testing.T) {
+	headers := amqp.Table{
+		VersionHeader: "2",
+		"x-attempt":   int32(3),
+		"x-size":      int64(1 << 40),
+		"x-ratio":     float32(0.5),
+		"x-retried":   true,
+		"x-sent-at":   time.Unix(1700000000, 0).UTC(),
+		"x-raw":       []byte("raw"),
+		"x-death":     []interface{}{amqp.Table{"count": int64(1), "queue": "orders"}},
+		"x-none":      nil,
+	}
+	recorded, err := recordHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]RecordedValue
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := replayHeaders(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed, headers) {
+		t.Errorf("Expected %#v got %#v", headers, replayed)
+	}
+
+	if _, err := recordHeaders(amqp.Table{"x-bad": struct{}{}}); err == nil {
+		t.Error("Expected a header value of an unknown type to fail")
+	}
+}
+
+func TestRecordersGetEveryEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddRecorder(recorder)
+	// far more than the hooks queue holds, none of them may be dropped
+	for i := 0; i < hookQueueSize*2; i++ {
+		recordReceived(&Event{OriginalMessage: amqp.Delivery{Body: []byte(`{"event": "replay_ok"}`)}})
+	}
+	RemoveRecorder(recorder)
+	recordReceived(&Event{OriginalMessage: amqp.Delivery{Body: []byte(`{"event": "replay_ok"}`)}})
+	recorder.Close()
+
+	results, err := Replay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != hookQueueSize*2 {
+		t.Errorf("Expected %d recorded events got %d", hookQueueSize*2, len(results))
+	}
+}
+
+type nackCounter struct {
+	amqp.Acknowledger
+	nacked int
+}
+
+func (ack *nackCounter) Nack(tag uint64, multiple bool, requeue bool) error {
+	ack.nacked++
+	return nil
+}
+
+func TestMessagesReceivedWhilePausedArentRecorded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddRecorder(recorder)
+	defer RemoveRecorder(recorder)
+
+	Pause()
+	ack := &nackCounter{}
+	receive(amqp.Delivery{Acknowledger: ack, Body: []byte(`{"event": "replay_ok"}`)}, nil, nil)
+	if ack.nacked != 1 {
+		t.Fatalf("Expected the message to go back to the queue got %d nacks", ack.nacked)
+	}
+	Resume()
+	// the same message, redelivered once the worker resumed
+	jobs := make(chan *Event, 1)
+	receive(amqp.Delivery{Acknowledger: ack, Body: []byte(`{"event": "replay_ok"}`)}, nil, jobs)
+	event := <-jobs
+	state.finishJob(state.startQueuedJob(0, event), event.Name, nil, 0)
+	RemoveRecorder(recorder)
+	recorder.Close()
+
+	results, err := Replay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Errorf("Expected the message to be recorded once got %d", len(results))
+	}
+}
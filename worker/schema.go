@@ -0,0 +1,334 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// Schema is the subset of JSON Schema the worker validates event params against.
+// It can be parsed from a JSON Schema document with ParseSchema or derived from a
+// Go struct with SchemaFromStruct.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	// Nullable also accepts null, it is set by a type list such as ["string", "null"].
+	Nullable bool `json:"nullable,omitempty"`
+}
+
+// UnmarshalJSON reads type either as a single type or as a list of a type and null.
+func (schema *Schema) UnmarshalJSON(data []byte) error {
+	type plainSchema Schema
+	var document struct {
+		*plainSchema
+		Type interface{} `json:"type"`
+	}
+	document.plainSchema = (*plainSchema)(schema)
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	switch t := document.Type.(type) {
+	case nil:
+	case string:
+		schema.Type = t
+	case []interface{}:
+		types := []string{}
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return errors.Newf("Schema type %v isn't a string", item)
+			}
+			if name == "null" {
+				schema.Nullable = true
+				continue
+			}
+			types = append(types, name)
+		}
+		if len(types) > 1 {
+			return errors.Newf("Schema types %v aren't supported, only one type and null", types)
+		}
+		if len(types) == 1 {
+			schema.Type = types[0]
+		} else {
+			schema.Type = "null"
+		}
+	default:
+		return errors.Newf("Schema type %v isn't a string or a list", t)
+	}
+	return nil
+}
+
+type schemaKey struct {
+	event   string
+	version int
+}
+
+var (
+	schemasLock sync.RWMutex
+	schemas     = map[schemaKey]*Schema{}
+)
+
+// RegisterSchema makes the worker validate the params of every eventName event with
+// the given version before handing it to its task. Invalid events go straight to the
+// failed queue.
+func RegisterSchema(eventName string, version int, schema *Schema) {
+	schemasLock.Lock()
+	defer schemasLock.Unlock()
+	schemas[schemaKey{eventName, version}] = schema
+}
+
+// ParseSchema reads a JSON Schema document.
+func ParseSchema(data []byte) (*Schema, error) {
+	schema := &Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, errors.Wrap(err, "Couldn't parse schema")
+	}
+	return schema, nil
+}
+
+// SchemaFromStruct derives a schema from the json tags of a struct. Fields are
+// required unless they are pointers or tagged with omitempty, pointers also accept
+// null and unsigned integers can't be negative. Byte slices are strings, as they are
+// base64 encoded, and types with their own MarshalJSON accept anything. A struct that
+// refers back to itself, e.g. through a Next pointer, is an open object where it repeats.
+func SchemaFromStruct(v interface{}) *Schema {
+	return schemaFromType(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaFromType derives the schema of t, visiting holds the structs it is inside of.
+func schemaFromType(t reflect.Type, visiting map[reflect.Type]bool) *Schema {
+	if t.Kind() == reflect.Ptr {
+		schema := schemaFromType(t.Elem(), visiting)
+		schema.Nullable = true
+		return schema
+	}
+	if t == timeType {
+		return &Schema{Type: "string"}
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		minimum := 0.0
+		return &Schema{Type: "integer", Minimum: &minimum}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string"}
+		}
+		return &Schema{Type: "array", Items: schemaFromType(t.Elem(), visiting)}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		if visiting[t] {
+			return &Schema{Type: "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		addStructFields(schema, t, visiting, false)
+		sort.Strings(schema.Required)
+		return schema
+	}
+	return &Schema{}
+}
+
+// addStructFields adds the fields of t to schema, flattening embedded structs like
+// encoding/json does. The fields of an embedded pointer are optional, it may be nil.
+func addStructFields(schema *Schema, t reflect.Type, visiting map[reflect.Type]bool, optionalFields bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				// encoding/json can't set the fields of an unexported embedded pointer
+				if field.PkgPath != "" && field.Type.Kind() == reflect.Ptr {
+					continue
+				}
+				if !visiting[embedded] {
+					visiting[embedded] = true
+					addStructFields(schema, embedded, visiting, optionalFields || field.Type.Kind() == reflect.Ptr)
+					delete(visiting, embedded)
+				}
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = schemaFromType(field.Type, visiting)
+		optional := optionalFields || field.Type.Kind() == reflect.Ptr
+		for _, option := range parts[1:] {
+			if option == "omitempty" {
+				optional = true
+			}
+		}
+		if !optional {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// validateEvent checks the event params against the schema registered for its name
+// and version, if there is one.
+func validateEvent(event *Event) error {
+	schemasLock.RLock()
+	schema, ok := schemas[schemaKey{event.Name, event.Version}]
+	schemasLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	problems := schema.Validate(event.Params)
+	if len(problems) > 0 {
+		return errors.Newf("Event %s version %d is invalid: %s", event.Name, event.Version, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Validate returns a description of every place value doesn't match the schema,
+// each prefixed with the path to the offending value.
+func (schema *Schema) Validate(value interface{}) []string {
+	problems := []string{}
+	schema.validate("$", value, &problems)
+	return problems
+}
+
+func (schema *Schema) validate(path string, value interface{}, problems *[]string) {
+	if value == nil && schema.Nullable {
+		return
+	}
+	if schema.Type != "" && !matchesType(schema.Type, value) {
+		*problems = append(*problems, fmt.Sprintf("%s should be %s but is %s", path, schema.Type, jsonType(value)))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		*problems = append(*problems, fmt.Sprintf("%s should be one of %v but is %v", path, schema.Enum, value))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s.%s is required", path, name))
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := schema.Properties[key]; ok {
+				property.validate(path+"."+key, v[key], problems)
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				*problems = append(*problems, fmt.Sprintf("%s.%s is not allowed", path, key))
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				schema.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, problems)
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			*problems = append(*problems, fmt.Sprintf("%s should be at least %d characters long", path, *schema.MinLength))
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			*problems = append(*problems, fmt.Sprintf("%s should be at most %d characters long", path, *schema.MaxLength))
+		}
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			*problems = append(*problems, fmt.Sprintf("%s should be at least %v but is %v", path, *schema.Minimum, v))
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			*problems = append(*problems, fmt.Sprintf("%s should be at most %v but is %v", path, *schema.Maximum, v))
+		}
+	}
+}
+
+// matchesType checks a value decoded by encoding/json against a JSON Schema type.
+func matchesType(schemaType string, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return schemaType == "null"
+	case bool:
+		return schemaType == "boolean"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && v == float64(int64(v)))
+	case string:
+		return schemaType == "string"
+	case []interface{}:
+		return schemaType == "array"
+	case map[string]interface{}:
+		return schemaType == "object"
+	}
+	return false
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
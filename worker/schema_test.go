@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type orderPlaced struct {
+	Event   string   `json:"event"`
+	OrderID int      `json:"order_id"`
+	Amount  float64  `json:"amount"`
+	Tags    []string `json:"tags,omitempty"`
+	Coupon  *string  `json:"coupon"`
+	Units   uint     `json:"units,omitempty"`
+	secret  string
+}
+
+func TestSchemaFromStruct(t *testing.T) {
+	schema := SchemaFromStruct(orderPlaced{})
+	if strings.Join(schema.Required, ",") != "amount,event,order_id" {
+		t.Errorf("Unexpected required fields %v", schema.Required)
+	}
+	if schema.Properties["order_id"].Type != "integer" || schema.Properties["tags"].Items.Type != "string" {
+		t.Errorf("Unexpected properties %+v", schema.Properties)
+	}
+	if _, ok := schema.Properties["secret"]; ok {
+		t.Error("Expected unexported fields to be skipped")
+	}
+
+	problems := schema.Validate(map[string]interface{}{
+		"event":    "order_placed",
+		"order_id": 1.5,
+		"tags":     []interface{}{"a", 2.0},
+	})
+	expected := []string{
+		"$.amount is required",
+		"$.order_id should be integer but is number",
+		"$.tags[1] should be string but is number",
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v got %v", expected, problems)
+	}
+}
+
+func TestSchemaFromStructNullAndUnsigned(t *testing.T) {
+	schema := SchemaFromStruct(orderPlaced{})
+	valid := map[string]interface{}{"event": "order_placed", "order_id": 1.0, "amount": 5.0, "coupon": nil, "units": 0.0}
+	if problems := schema.Validate(valid); len(problems) != 0 {
+		t.Errorf("Expected a null pointer field to be valid got %v", problems)
+	}
+	invalid := map[string]interface{}{"event": nil, "order_id": 1.0, "amount": 5.0, "units": -1.0}
+	expected := []string{
+		"$.event should be string but is null",
+		"$.units should be at least 0 but is -1",
+	}
+	if problems := schema.Validate(invalid); strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v got %v", expected, problems)
+	}
+}
+
+type orderNode struct {
+	ID       int          `json:"id"`
+	Next     *orderNode   `json:"next"`
+	Children []orderNode  `json:"children,omitempty"`
+	Sibling  *orderPlaced `json:"sibling"`
+}
+
+func TestSchemaFromSelfReferencingStruct(t *testing.T) {
+	schema := SchemaFromStruct(orderNode{})
+	next := schema.Properties["next"]
+	if next.Type != "object" || !next.Nullable || next.Properties != nil {
+		t.Errorf("Expected the repeated struct to be an open object got %+v", next)
+	}
+	if children := schema.Properties["children"]; children.Items.Type != "object" || children.Items.Properties != nil {
+		t.Errorf("Expected the repeated struct items to be open objects got %+v", children.Items)
+	}
+	if sibling := schema.Properties["sibling"]; sibling.Properties["order_id"] == nil {
+		t.Errorf("Expected other structs to be described got %+v", sibling)
+	}
+
+	valid := map[string]interface{}{"id": 1.0, "next": map[string]interface{}{"id": 2.0, "next": nil}, "sibling": nil}
+	if problems := schema.Validate(valid); len(problems) != 0 {
+		t.Errorf("Expected a linked node to be valid got %v", problems)
+	}
+}
+
+func TestParseSchemaTypeList(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"type": "object", "properties": {"coupon": {"type": ["string", "null"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coupon := schema.Properties["coupon"]; coupon.Type != "string" || !coupon.Nullable {
+		t.Errorf("Expected a nullable string got %+v", coupon)
+	}
+	if problems := schema.Validate(map[string]interface{}{"coupon": nil}); len(problems) != 0 {
+		t.Errorf("Expected null to be valid got %v", problems)
+	}
+	if problems := schema.Validate(map[string]interface{}{"coupon": 5.0}); len(problems) != 1 {
+		t.Errorf("Expected a number to be invalid got %v", problems)
+	}
+	if _, err := ParseSchema([]byte(`{"type": ["string", "number"]}`)); err == nil {
+		t.Error("Expected a list of several types to be rejected")
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["event", "status"],
+		"additionalProperties": false,
+		"properties": {
+			"event": {"type": "string"},
+			"status": {"enum": ["active", "paused"]},
+			"price": {"type": "number", "minimum": 5}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string]interface{}{"event": "gig_updated", "status": "active", "price": 10.0}
+	if problems := schema.Validate(valid); len(problems) != 0 {
+		t.Errorf("Expected no problems got %v", problems)
+	}
+	invalid := map[string]interface{}{"event": "gig_updated", "status": "deleted", "price": 1.0, "extra": true}
+	if problems := schema.Validate(invalid); len(problems) != 3 {
+		t.Errorf("Expected 3 problems got %v", problems)
+	}
+}
+
+func TestValidateEventUsesVersion(t *testing.T) {
+	RegisterSchema("schema_test", 2, SchemaFromStruct(orderPlaced{}))
+	defer func() {
+		schemasLock.Lock()
+		delete(schemas, schemaKey{"schema_test", 2})
+		schemasLock.Unlock()
+	}()
+
+	params := map[string]interface{}{"event": "schema_test"}
+	if err := validateEvent(&Event{Name: "schema_test", Version: 1, Params: params}); err != nil {
+		t.Errorf("Expected version 1 to have no schema got %s", err)
+	}
+	if err := validateEvent(&Event{Name: "schema_test", Version: 2, Params: params}); err == nil {
+		t.Error("Expected version 2 to be invalid")
+	}
+}
+
+// OrderAudit is exported, encoding/json skips embedded pointers to unexported structs.
+type OrderAudit struct {
+	By string `json:"by"`
+}
+
+type orderArchived struct {
+	*orderPlaced
+	*OrderAudit
+	Receipt []byte          `json:"receipt"`
+	Extra   json.RawMessage `json:"extra"`
+	At      time.Time       `json:"at"`
+}
+
+func TestSchemaFromStructBytesAndMarshalers(t *testing.T) {
+	schema := SchemaFromStruct(orderArchived{})
+	if receipt := schema.Properties["receipt"]; receipt.Type != "string" {
+		t.Errorf("Expected bytes to be a base64 string got %+v", receipt)
+	}
+	if extra := schema.Properties["extra"]; extra.Type != "" || extra.Items != nil {
+		t.Errorf("Expected a raw message to accept anything got %+v", extra)
+	}
+	if at := schema.Properties["at"]; at.Type != "string" {
+		t.Errorf("Expected a time to be a string got %+v", at)
+	}
+
+	receipt, _ := json.Marshal(orderArchived{Receipt: []byte("paid"), Extra: json.RawMessage(`{"gift":true}`)})
+	var params map[string]interface{}
+	json.Unmarshal(receipt, &params)
+	if problems := schema.Validate(params); len(problems) != 0 {
+		t.Errorf("Expected a marshaled event to be valid got %v", problems)
+	}
+}
+
+func TestSchemaFromStructEmbeddedPointer(t *testing.T) {
+	schema := SchemaFromStruct(orderArchived{})
+	if schema.Properties["by"] == nil {
+		t.Errorf("Expected the embedded pointer to be flattened got %+v", schema.Properties)
+	}
+	if schema.Properties["order_id"] != nil {
+		t.Errorf("Expected the embedded pointer to an unexported struct to be skipped got %+v", schema.Properties)
+	}
+	if strings.Join(schema.Required, ",") != "at,extra,receipt" {
+		t.Errorf("Expected the fields of embedded pointers to be optional got %v", schema.Required)
+	}
+	if _, ok := schema.Properties["OrderAudit"]; ok {
+		t.Error("Expected no property for the embedded pointer itself")
+	}
+	if problems := schema.Validate(map[string]interface{}{"receipt": "", "extra": nil, "at": "", "by": 5.0}); len(problems) != 1 {
+		t.Errorf("Expected the flattened field to be validated got %v", problems)
+	}
+}
@@ -0,0 +1,49 @@
+package worker
+
+import (
+	"sync"
+	"github.com/roeepolegfiverr/gofiverr/encryption"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+const redactedValue = "[REDACTED]"
+
+var (
+	sensitiveLock  sync.RWMutex
+	keyring        *encryption.Keyring
+	redactedFields = map[string]bool{}
+)
+
+// SetKeyring lets the worker decrypt events encrypted by the publisher. Tasks get
+// the decrypted params, the failed queue keeps the encrypted envelope.
+func SetKeyring(k *encryption.Keyring) {
+	sensitiveLock.Lock()
+	defer sensitiveLock.Unlock()
+	keyring = k
+}
+
+// RedactFields hides the values of these params, at any depth, when a clear text
+// event is stored in the failed queue.
+func RedactFields(fields ...string) {
+	sensitiveLock.Lock()
+	defer sensitiveLock.Unlock()
+	for _, field := range fields {
+		redactedFields[field] = true
+	}
+}
+
+func isRedacted(field string) bool {
+	sensitiveLock.RLock()
+	defer sensitiveLock.RUnlock()
+	return redactedFields[field]
+}
+
+func openParams(params map[string]interface{}) (map[string]interface{}, error) {
+	sensitiveLock.RLock()
+	k := keyring
+	sensitiveLock.RUnlock()
+	if k == nil {
+		return nil, errors.New("Got an encrypted event but no keyring is set")
+	}
+	return k.Open(params)
+}
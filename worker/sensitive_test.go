@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/streadway/amqp"
+	"testing"
+	"github.com/roeepolegfiverr/gofiverr/encryption"
+)
+
+func TestParseEncryptedMessage(t *testing.T) {
+	k := encryption.NewKeyring()
+	k.AddKey("k1", bytes.Repeat([]byte{7}, 32))
+	sealed, _ := k.Seal("order_paid", map[string]interface{}{"event": "order_paid", "card": "4111"})
+	body, _ := json.Marshal(sealed)
+
+	SetKeyring(nil)
+	if event, err := parseMessage(amqp.Delivery{Body: body}); err == nil || event.Valid {
+		t.Error("Expected an encrypted event to be invalid without a keyring")
+	}
+
+	SetKeyring(k)
+	defer SetKeyring(nil)
+	event, err := parseMessage(amqp.Delivery{Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card, _ := event.GetString("card"); card != "4111" || event.Name != "order_paid" {
+		t.Errorf("Expected decrypted params got %v", event.Params)
+	}
+}
+
+func TestParsePlainMessageWithEncryptedField(t *testing.T) {
+	SetKeyring(nil)
+	event, err := parseMessage(amqp.Delivery{Body: []byte(`{"event": "gig_updated", "encrypted": false}`)})
+	if err != nil || !event.Valid {
+		t.Fatalf("Expected a plain event with an encrypted field to be valid got %v", err)
+	}
+	if encrypted, _ := event.GetBool("encrypted"); encrypted || event.Params["encrypted"] != false {
+		t.Errorf("Expected the encrypted param to be kept got %v", event.Params)
+	}
+}
+
+func TestSanitizeMessageRedacts(t *testing.T) {
+	RedactFields("password")
+	defer func() {
+		sensitiveLock.Lock()
+		delete(redactedFields, "password")
+		sensitiveLock.Unlock()
+	}()
+
+	sanitized := sanitizeMessage(hash{
+		"event": "user_created",
+		"user":  map[string]interface{}{"email.address": "a@b.c", "password": "secret"},
+	})
+	user := sanitized["user"].(hash)
+	if user["password"] != redactedValue {
+		t.Errorf("Expected nested password to be redacted got %v", user["password"])
+	}
+	if user["email_address"] != "a@b.c" {
+		t.Errorf("Expected nested keys to be fixed for mongo got %v", user)
+	}
+}
+
+func TestSanitizeMessageRedactsInsideArrays(t *testing.T) {
+	RedactFields("card")
+	defer func() {
+		sensitiveLock.Lock()
+		delete(redactedFields, "card")
+		sensitiveLock.Unlock()
+	}()
+
+	sanitized := sanitizeMessage(hash{
+		"event": "order_paid",
+		"items": []interface{}{
+			map[string]interface{}{"card": "4111", "gig.id": 5.0},
+			[]interface{}{map[string]interface{}{"card": "5500"}},
+			"gig",
+		},
+	})
+	items := sanitized["items"].([]interface{})
+	first := items[0].(hash)
+	if first["card"] != redactedValue || first["gig_id"] != 5.0 {
+		t.Errorf("Expected the card in the array to be redacted and keys fixed got %v", first)
+	}
+	if nested := items[1].([]interface{})[0].(hash); nested["card"] != redactedValue {
+		t.Errorf("Expected the card in the nested array to be redacted got %v", nested)
+	}
+	if items[2] != "gig" {
+		t.Errorf("Expected plain values to be kept got %v", items[2])
+	}
+}
@@ -0,0 +1,421 @@
+package worker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+	"github.com/roeepolegfiverr/gofiverr/logger"
+)
+
+// Status is a point in time snapshot of the worker, as exposed by the admin endpoint.
+type Status struct {
+	Worker    string               `json:"worker"`
+	Queue     string               `json:"queue"`
+	Connected bool                 `json:"connected"`
+	Paused    bool                 `json:"paused"`
+	PausedBy  []string             `json:"paused_by"`
+	PoolSize  int                  `json:"pool_size"`
+	StartedAt time.Time            `json:"started_at"`
+	Tasks     []string             `json:"tasks"`
+	InFlight  []InFlightJob        `json:"in_flight"`
+	TaskStats map[string]TaskStats `json:"task_stats"`
+	// DroppedHookCalls counts hook calls skipped because hooks fell behind.
+	DroppedHookCalls int64 `json:"dropped_hook_calls"`
+}
+
+// InFlightJob describes an event that one of the minions is working on right now.
+type InFlightJob struct {
+	ID        uint64    `json:"id"`
+	Event     string    `json:"event"`
+	Minion    int       `json:"minion"`
+	StartedAt time.Time `json:"started_at"`
+	Age       float64   `json:"age_seconds"`
+}
+
+// TaskStats counts the outcomes of a single task since the worker started.
+type TaskStats struct {
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+}
+
+type inFlightJob struct {
+	event     string
+	minion    int
+	startedAt time.Time
+}
+
+// Who paused the worker, it only resumes once all of them have resumed it.
+const (
+	pausedByAdmin   = "admin"
+	pausedByBreaker = "breaker"
+	pausedByDrain   = "drain"
+)
+
+// workerState holds everything the running worker knows about itself.
+type workerState struct {
+	sync.Mutex
+	workerName   string
+	queueName    string
+	consumerName string
+	broker       Broker
+	connected    bool
+	pausedBy     map[string]bool
+	resume       chan struct{}
+	// draining counts the Drain calls in progress, Resume leaves their pause alone.
+	draining int
+	// queued counts the events Consume handed on whose job didn't start yet, e.g.
+	// waiting for a free minion or for their batch to fill up.
+	queued       int
+	startedAt    time.Time
+	pool         *pool
+	nextJobID    uint64
+	inFlight     map[uint64]*inFlightJob
+	stats        map[string]*TaskStats
+	latencyTotal time.Duration
+	latencyCount int64
+	// autoscaleStop is closed to stop the autoscaler, nil while it isn't running.
+	autoscaleStop chan struct{}
+}
+
+var state = newWorkerState()
+
+func newWorkerState() *workerState {
+	return &workerState{
+		resume:   make(chan struct{}),
+		pausedBy: map[string]bool{},
+		inFlight: map[uint64]*inFlightJob{},
+		stats:    map[string]*TaskStats{},
+	}
+}
+
+func (s *workerState) start(workerName string, queueName string, p *pool) {
+	s.Lock()
+	defer s.Unlock()
+	s.workerName = workerName
+	s.queueName = queueName
+	s.pool = p
+	s.startedAt = time.Now()
+}
+
+// startAutoscaler starts autoscaling the pool, if it is enabled and not running yet.
+func (s *workerState) startAutoscaler() {
+	if autoscaling == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.autoscaleStop != nil || s.pool == nil {
+		return
+	}
+	s.autoscaleStop = make(chan struct{})
+	go autoscale(s.queueName, *autoscaling, s.pool, s.autoscaleStop)
+}
+
+func (s *workerState) stopAutoscaler() {
+	s.Lock()
+	defer s.Unlock()
+	if s.autoscaleStop != nil {
+		close(s.autoscaleStop)
+		s.autoscaleStop = nil
+	}
+}
+
+func (s *workerState) worker() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.workerName
+}
+
+func (s *workerState) queue() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.queueName
+}
+
+func (s *workerState) setConsumer(b Broker, consumerName string) {
+	s.Lock()
+	defer s.Unlock()
+	s.broker = b
+	s.consumerName = consumerName
+	s.connected = b != nil
+	// paused while connecting, pause had no consumer to cancel yet
+	if s.connected && len(s.pausedBy) > 0 {
+		if err := b.Cancel(consumerName); err != nil {
+			logger.ErrorLog(errors.Wrap(err, "Couldn't cancel consumer"))
+		}
+	}
+}
+
+func (s *workerState) setConnected(connected bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.connected = connected
+}
+
+// queueJob counts an event Consume hands on, until startQueuedJob starts its job.
+func (s *workerState) queueJob() {
+	s.Lock()
+	defer s.Unlock()
+	s.queued++
+}
+
+// startQueuedJob starts the job of an event counted by queueJob.
+func (s *workerState) startQueuedJob(minion int, event *Event) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.queued--
+	return s.startJobLocked(minion, event)
+}
+
+func (s *workerState) startJob(minion int, event *Event) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.startJobLocked(minion, event)
+}
+
+func (s *workerState) startJobLocked(minion int, event *Event) uint64 {
+	s.nextJobID++
+	s.inFlight[s.nextJobID] = &inFlightJob{
+		event:     event.Name,
+		minion:    minion,
+		startedAt: time.Now(),
+	}
+	return s.nextJobID
+}
+
+func (s *workerState) finishJob(id uint64, eventName string, err error, elapsed time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.inFlight, id)
+	s.latencyTotal += elapsed
+	s.latencyCount++
+	stats, ok := s.stats[eventName]
+	if !ok {
+		stats = &TaskStats{}
+		s.stats[eventName] = stats
+	}
+	if err != nil {
+		stats.Failed++
+	} else {
+		stats.Succeeded++
+	}
+}
+
+// takeLatency returns the average job duration since the last call and starts a new window.
+func (s *workerState) takeLatency() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if s.latencyCount == 0 {
+		return 0
+	}
+	avg := s.latencyTotal / time.Duration(s.latencyCount)
+	s.latencyTotal = 0
+	s.latencyCount = 0
+	return avg
+}
+
+// pause cancels the consumer so the broker stops pushing messages to us, on behalf
+// of by. Consume notices the closed deliveries channel and waits for resume.
+func (s *workerState) pause(by string) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pausedBy) > 0 {
+		s.pausedBy[by] = true
+		return nil
+	}
+	if s.broker != nil && s.connected {
+		if err := s.broker.Cancel(s.consumerName); err != nil {
+			return errors.Wrap(err, "Couldn't cancel consumer")
+		}
+	}
+	s.pausedBy[by] = true
+	return nil
+}
+
+// unpause takes back the pause of by, the worker resumes when nobody else paused it.
+func (s *workerState) unpause(by string) {
+	s.Lock()
+	defer s.Unlock()
+	s.release(by)
+}
+
+// resumeByAdmin takes back the admin pause and the pause of a drain that is over.
+func (s *workerState) resumeByAdmin() {
+	s.Lock()
+	defer s.Unlock()
+	s.release(pausedByAdmin)
+	if s.draining == 0 {
+		s.release(pausedByDrain)
+	}
+}
+
+func (s *workerState) release(by string) {
+	if !s.pausedBy[by] {
+		return
+	}
+	delete(s.pausedBy, by)
+	if len(s.pausedBy) > 0 {
+		return
+	}
+	close(s.resume)
+	s.resume = make(chan struct{})
+}
+
+// startDrain pauses the worker for a drain, endDrain must follow.
+func (s *workerState) startDrain() error {
+	s.Lock()
+	s.draining++
+	s.Unlock()
+	if err := s.pause(pausedByDrain); err != nil {
+		s.endDrain()
+		return err
+	}
+	return nil
+}
+
+func (s *workerState) endDrain() {
+	s.Lock()
+	defer s.Unlock()
+	s.draining--
+}
+
+// remaining is how many events the worker is still working on or about to, and
+// whether it is still consuming.
+func (s *workerState) remaining() (events int, consuming bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.queued + len(s.inFlight), s.connected
+}
+
+func (s *workerState) isPaused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.pausedBy) > 0
+}
+
+// waitWhilePaused blocks until the worker is resumed. It returns right away if
+// the worker is not paused.
+func (s *workerState) waitWhilePaused() {
+	s.Lock()
+	if len(s.pausedBy) == 0 {
+		s.Unlock()
+		return
+	}
+	resume := s.resume
+	s.Unlock()
+	<-resume
+}
+
+func (s *workerState) snapshot() Status {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	status := Status{
+		Worker:    s.workerName,
+		Queue:     s.queueName,
+		Connected: s.connected,
+		Paused:    len(s.pausedBy) > 0,
+		PausedBy:  []string{},
+		StartedAt: s.startedAt,
+		Tasks:     []string{},
+		InFlight:  []InFlightJob{},
+		TaskStats: map[string]TaskStats{},
+
+		DroppedHookCalls: dispatcher.droppedCalls(),
+	}
+	for by := range s.pausedBy {
+		status.PausedBy = append(status.PausedBy, by)
+	}
+	sort.Strings(status.PausedBy)
+	if s.pool != nil {
+		status.PoolSize = s.pool.size()
+	}
+	for name := range Tasks.Tasks {
+		status.Tasks = append(status.Tasks, name)
+	}
+	for name := range Tasks.BatchTasks {
+		status.Tasks = append(status.Tasks, name)
+	}
+	sort.Strings(status.Tasks)
+	for id, job := range s.inFlight {
+		status.InFlight = append(status.InFlight, InFlightJob{
+			ID:        id,
+			Event:     job.event,
+			Minion:    job.minion,
+			StartedAt: job.startedAt,
+			Age:       now.Sub(job.startedAt).Seconds(),
+		})
+	}
+	sort.Slice(status.InFlight, func(i, j int) bool {
+		return status.InFlight[i].ID < status.InFlight[j].ID
+	})
+	for name, stats := range s.stats {
+		status.TaskStats[name] = *stats
+	}
+	return status
+}
+
+// CurrentStatus returns a snapshot of the running worker.
+func CurrentStatus() Status {
+	return state.snapshot()
+}
+
+// Pause stops pulling new messages from the queue. Jobs already in flight are finished.
+func Pause() error {
+	return state.pause(pausedByAdmin)
+}
+
+// Resume starts pulling messages again after Pause or Drain. The worker stays paused
+// while the circuit breaker is open or it is being drained, see Status.PausedBy.
+func Resume() {
+	state.resumeByAdmin()
+	if !state.isPaused() {
+		state.startAutoscaler()
+	}
+}
+
+// Drain pauses the worker and waits until it stopped consuming and every event it
+// received was worked on, including the ones waiting for a minion, or for ctx to be
+// done. Batches are flushed rather than left to fill up and the autoscaler stops. Use
+// it to stop a worker without losing work, it stays paused until Resume.
+func Drain(ctx context.Context) error {
+	if err := state.startDrain(); err != nil {
+		return err
+	}
+	defer state.endDrain()
+	state.stopAutoscaler()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		events, consuming := state.remaining()
+		if events == 0 && !consuming {
+			return nil
+		}
+		flushBatches()
+		select {
+		case <-ctx.Done():
+			if consuming {
+				return errors.Newf("Still consuming with %d events being worked on", events)
+			}
+			return errors.Newf("%d events still being worked on", events)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ResizePool changes the number of minions working on messages.
+func ResizePool(size int) error {
+	if size < 1 {
+		return errors.Newf("Pool size must be positive, got %d", size)
+	}
+	state.Lock()
+	p := state.pool
+	state.Unlock()
+	if p == nil {
+		return errors.New("Worker is not running")
+	}
+	p.resize(size)
+	return nil
+}
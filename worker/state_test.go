@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolResize(t *testing.T) {
+	p := newPool(make(chan *Event), 2)
+	if p.size() != 2 {
+		t.Errorf("Expected 2 minions got %d", p.size())
+	}
+	p.resize(5)
+	if p.size() != 5 {
+		t.Errorf("Expected 5 minions got %d", p.size())
+	}
+	p.resize(1)
+	if p.size() != 1 {
+		t.Errorf("Expected 1 minion got %d", p.size())
+	}
+}
+
+func TestStateCountsJobs(t *testing.T) {
+	s := newWorkerState()
+	event := &Event{Name: "test"}
+	first := s.startJob(0, event)
+	second := s.startJob(1, event)
+	if jobs := s.snapshot().InFlight; len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs in flight got %d", len(jobs))
+	}
+	s.finishJob(first, event.Name, nil, time.Second)
+	s.finishJob(second, event.Name, errors.New("boom"), 3*time.Second)
+
+	status := s.snapshot()
+	if len(status.InFlight) != 0 {
+		t.Errorf("Expected no jobs in flight got %d", len(status.InFlight))
+	}
+	if stats := status.TaskStats["test"]; stats.Succeeded != 1 || stats.Failed != 1 {
+		t.Errorf("Expected 1 success and 1 failure got %+v", stats)
+	}
+	if latency := s.takeLatency(); latency != 2*time.Second {
+		t.Errorf("Expected average latency of 2s got %s", latency)
+	}
+	if latency := s.takeLatency(); latency != 0 {
+		t.Errorf("Expected latency window to reset got %s", latency)
+	}
+}
+
+func TestStatePauseResume(t *testing.T) {
+	s := newWorkerState()
+	if err := s.pause(pausedByAdmin); err != nil {
+		t.Fatal(err)
+	}
+	resumed := make(chan bool)
+	go func() {
+		s.waitWhilePaused()
+		resumed <- true
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("Expected to wait while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.unpause(pausedByAdmin)
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to resume")
+	}
+}
+
+func TestStateResumesOnlyWhenEveryPauseIsTakenBack(t *testing.T) {
+	s := newWorkerState()
+	s.pause(pausedByAdmin)
+	s.pause(pausedByBreaker)
+	s.unpause(pausedByBreaker)
+	if !s.isPaused() {
+		t.Fatal("Expected the breaker closing to leave the admin pause alone")
+	}
+	if by := s.snapshot().PausedBy; len(by) != 1 || by[0] != pausedByAdmin {
+		t.Errorf("Expected the worker to be paused by the admin only got %v", by)
+	}
+	s.unpause(pausedByBreaker)
+	if !s.isPaused() {
+		t.Fatal("Expected resuming a pause that isn't there to do nothing")
+	}
+	s.unpause(pausedByAdmin)
+	if s.isPaused() {
+		t.Error("Expected the worker to resume")
+	}
+}
+
+func TestDrainWaitsForJobsInFlight(t *testing.T) {
+	defer Resume()
+	id := state.startJob(0, &Event{Name: "test"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Drain(ctx); err == nil {
+		t.Errorf("Expected draining to time out with a job in flight")
+	}
+
+	state.finishJob(id, "test", nil, time.Millisecond)
+	if err := Drain(context.Background()); err != nil {
+		t.Errorf("Expected draining to finish, got %v", err)
+	}
+	if !state.isPaused() {
+		t.Errorf("Expected the worker to be paused")
+	}
+}
+
+type cancelRecorder struct {
+	Broker
+	canceled chan string
+}
+
+func (b *cancelRecorder) Cancel(consumerName string) error {
+	b.canceled <- consumerName
+	return nil
+}
+
+func TestDrainWaitsForConsumerAndQueuedEvents(t *testing.T) {
+	defer func(previous *workerState) { state = previous }(state)
+	state = newWorkerState()
+	b := &cancelRecorder{canceled: make(chan string, 1)}
+	state.setConsumer(b, "consumer")
+	// the consume loop is blocked handing an event to the minions
+	state.queueJob()
+
+	drained := make(chan error)
+	go func() { drained <- Drain(context.Background()) }()
+	if name := <-b.canceled; name != "consumer" {
+		t.Errorf("Expected the consumer to be canceled got %s", name)
+	}
+	state.setConnected(false)
+	select {
+	case err := <-drained:
+		t.Fatalf("Expected to wait for the queued event, got %v", err)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	id := state.startQueuedJob(0, &Event{Name: "test"})
+	state.finishJob(id, "test", nil, time.Millisecond)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected draining to finish")
+	}
+
+	if by := state.snapshot().PausedBy; len(by) != 1 || by[0] != pausedByDrain {
+		t.Errorf("Expected the worker to stay paused by the drain got %v", by)
+	}
+	Resume()
+	if state.isPaused() {
+		t.Error("Expected Resume to take back the pause of a finished drain")
+	}
+}
+
+func TestStatusWhileAddingTasks(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			Tasks.AddTask("status_task", func(event *Event) error { return nil })
+			Tasks.RemoveTask("status_task")
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		CurrentStatus()
+	}
+	<-done
+	for _, name := range CurrentStatus().Tasks {
+		if name == "status_task" {
+			t.Errorf("Expected the removed task to be gone")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"github.com/streadway/amqp"
+	"math"
+	"strconv"
+	"sync"
+	"github.com/roeepolegfiverr/gofiverr/errors"
+)
+
+// VersionHeader is the AMQP header producers may set to the version of the event
+// payload. It wins over a "version" field in the payload itself.
+const VersionHeader = "x-event-version"
+
+// Upcaster migrates the params of an event from one version to the next one.
+type Upcaster func(params map[string]interface{}) (map[string]interface{}, error)
+
+var (
+	upcastersLock sync.RWMutex
+	upcasters     = map[schemaKey]Upcaster{}
+)
+
+// RegisterUpcaster registers the migration of eventName params from fromVersion to
+// fromVersion+1. Before dispatching, the worker chains upcasters until there are no
+// more for the event version, so tasks only ever see the latest shape. The version
+// reached is in Event.Version, a "version" param is only updated if the payload had one.
+func RegisterUpcaster(eventName string, fromVersion int, upcaster Upcaster) {
+	upcastersLock.Lock()
+	defer upcastersLock.Unlock()
+	upcasters[schemaKey{eventName, fromVersion}] = upcaster
+}
+
+// upcastEvent brings an event to the latest version we know how to migrate it to.
+func upcastEvent(event *Event) error {
+	for {
+		upcastersLock.RLock()
+		upcaster, ok := upcasters[schemaKey{event.Name, event.Version}]
+		upcastersLock.RUnlock()
+		if !ok {
+			return nil
+		}
+
+		_, versioned := event.Params["version"]
+		params, err := upcaster(event.Params)
+		if err != nil {
+			return errors.Wrapf(err, "Couldn't upcast event %s from version %d", event.Name, event.Version)
+		}
+		if params == nil {
+			return errors.Newf("Upcaster of event %s version %d returned no params", event.Name, event.Version)
+		}
+		event.Version++
+		// only payloads that carry their version get it updated, the others may
+		// come with the header alone or have a schema that doesn't allow it
+		if versioned {
+			// keep the same type encoding/json gives us for numbers
+			params["version"] = float64(event.Version)
+		}
+		event.Params = params
+	}
+}
+
+// prepareEvent migrates an event to its latest version and validates it.
+func prepareEvent(event *Event) error {
+	if err := upcastEvent(event); err != nil {
+		return err
+	}
+	return validateEvent(event)
+}
+
+// messageVersion reads the payload version from the message header, then from the
+// params, and defaults to 1.
+func messageVersion(message amqp.Delivery, params map[string]interface{}) int {
+	if val, ok := message.Headers[VersionHeader]; ok {
+		if version, err := toVersion(val); err == nil {
+			return version
+		}
+	}
+	if val, ok := params["version"]; ok {
+		if version, err := toVersion(val); err == nil {
+			return version
+		}
+	}
+	return 1
+}
+
+func toVersion(val interface{}) (int, error) {
+	switch v := val.(type) {
+	case int:
+		return v, nil
+	case int8:
+		return int(v), nil
+	case int16:
+		return int(v), nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, errors.Newf("Version %v is not a whole number", val)
+		}
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	case []byte:
+		return strconv.Atoi(string(v))
+	}
+	return 0, errors.Newf("Unsupported event version %v", val)
+}
@@ -0,0 +1,94 @@
+package worker
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestUpcastEvent(t *testing.T) {
+	RegisterUpcaster("upcast_test", 1, func(params map[string]interface{}) (map[string]interface{}, error) {
+		params["amount"] = map[string]interface{}{"value": params["price"], "currency": "USD"}
+		delete(params, "price")
+		return params, nil
+	})
+	RegisterUpcaster("upcast_test", 2, func(params map[string]interface{}) (map[string]interface{}, error) {
+		params["source"] = "web"
+		return params, nil
+	})
+	defer func() {
+		upcastersLock.Lock()
+		delete(upcasters, schemaKey{"upcast_test", 1})
+		delete(upcasters, schemaKey{"upcast_test", 2})
+		upcastersLock.Unlock()
+	}()
+
+	event := &Event{Name: "upcast_test", Version: 1, Params: map[string]interface{}{"price": 5.0, "version": 1.0}}
+	if err := upcastEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Version != 3 || event.Params["version"] != 3.0 {
+		t.Errorf("Expected event to reach version 3 got %d (%v)", event.Version, event.Params["version"])
+	}
+	if _, ok := event.Params["price"]; ok || event.Params["source"] != "web" {
+		t.Errorf("Unexpected params after upcasting %v", event.Params)
+	}
+
+	// the version of the header isn't added to the params
+	event = &Event{Name: "upcast_test", Version: 1, Params: map[string]interface{}{"price": 5.0}}
+	if err := upcastEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := event.Params["version"]; ok || event.Version != 3 {
+		t.Errorf("Expected version 3 without a version param got %d %v", event.Version, event.Params)
+	}
+
+	// events already on the latest version are left alone
+	event = &Event{Name: "upcast_test", Version: 3, Params: map[string]interface{}{}}
+	if err := upcastEvent(event); err != nil || event.Version != 3 {
+		t.Errorf("Expected version 3 to stay as is got %d %v", event.Version, err)
+	}
+}
+
+func TestUpcastEventFails(t *testing.T) {
+	RegisterUpcaster("upcast_fail", 1, func(params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, errors.New("missing price")
+	})
+	defer func() {
+		upcastersLock.Lock()
+		delete(upcasters, schemaKey{"upcast_fail", 1})
+		upcastersLock.Unlock()
+	}()
+
+	event := &Event{Name: "upcast_fail", Version: 1, Params: map[string]interface{}{}}
+	if err := upcastEvent(event); err == nil {
+		t.Error("Expected upcasting to fail")
+	}
+}
+
+func TestMessageVersion(t *testing.T) {
+	params := map[string]interface{}{"version": 2.0}
+	if version := messageVersion(amqp.Delivery{}, params); version != 2 {
+		t.Errorf("Expected version 2 from params got %d", version)
+	}
+	message := amqp.Delivery{Headers: amqp.Table{VersionHeader: int32(4)}}
+	if version := messageVersion(message, params); version != 4 {
+		t.Errorf("Expected version 4 from header got %d", version)
+	}
+	if version := messageVersion(amqp.Delivery{}, map[string]interface{}{}); version != 1 {
+		t.Errorf("Expected default version 1 got %d", version)
+	}
+}
+
+func TestToVersion(t *testing.T) {
+	for _, val := range []interface{}{2, int32(2), 2.0, "2", []byte("2")} {
+		if version, err := toVersion(val); err != nil || version != 2 {
+			t.Errorf("Expected %#v to be version 2 got %d, %v", val, version, err)
+		}
+	}
+	for _, val := range []interface{}{2.7, true, nil} {
+		if _, err := toVersion(val); err == nil {
+			t.Errorf("Expected %#v to be rejected", val)
+		}
+	}
+}